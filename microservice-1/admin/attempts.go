@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"log"
+	"net/http"
+)
+
+// handleDeliveryAttempts serves the delivery attempt log:
+//
+//	GET /delivery-attempts?message_id=...  every attempt of one message
+//
+// The message id is the Idempotency-Key of the message, by default
+// <topic>-<partition>-<offset>.
+func (s *Server) handleDeliveryAttempts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	messageID := r.URL.Query().Get("message_id")
+	if messageID == "" {
+		http.Error(w, "message_id is required", http.StatusBadRequest)
+		return
+	}
+	s.writeDeliveryAttempts(w, messageID)
+}
+
+// getFailedMessageAttempts answers with every delivery attempt of a failed
+// message, including those made before it was persisted.
+func (s *Server) getFailedMessageAttempts(w http.ResponseWriter, id int64) {
+	msg, err := s.DB.GetFailedMessage(id)
+	if err != nil {
+		log.Printf("Failed to load failed message %d: %v", id, err)
+		http.Error(w, "Failed to load failed message", http.StatusInternalServerError)
+		return
+	}
+	if msg == nil {
+		http.Error(w, "Failed message not found", http.StatusNotFound)
+		return
+	}
+	s.writeDeliveryAttempts(w, s.RetryHandler.MessageID(msg.Message))
+}
+
+// writeDeliveryAttempts answers with the attempts of messageID, oldest first.
+func (s *Server) writeDeliveryAttempts(w http.ResponseWriter, messageID string) {
+	attempts, err := s.DB.ListDeliveryAttempts(messageID)
+	if err != nil {
+		log.Printf("Failed to list delivery attempts of %s: %v", messageID, err)
+		http.Error(w, "Failed to list delivery attempts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, attempts)
+}
@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// actorKey is the context key of the actor of an authenticated request.
+type actorKey struct{}
+
+// authenticate rejects requests without an "Authorization: Bearer <token>"
+// header matching one of the configured tokens, and passes the actor the
+// token belongs to on to next, see actor.
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name := ""
+		if ok {
+			name = s.lookupToken(token)
+		}
+		if name == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, name)))
+	}
+}
+
+// lookupToken returns the actor token belongs to, or "" if it is not one of
+// the configured tokens. Every token is compared in constant time.
+func (s *Server) lookupToken(token string) string {
+	name := ""
+	for actor, t := range s.tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			name = actor
+		}
+	}
+	return name
+}
+
+// actor returns the actor of a request that passed authenticate.
+func actor(r *http.Request) string {
+	name, _ := r.Context().Value(actorKey{}).(string)
+	return name
+}
@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	s := &Server{tokens: map[string]string{"alice": "secret-a", "bob": "secret-b"}}
+	handler := s.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(actor(r)))
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+		wantActor     string
+	}{
+		{"first actor", "Bearer secret-a", http.StatusOK, "alice"},
+		{"second actor", "Bearer secret-b", http.StatusOK, "bob"},
+		{"actor name as token", "Bearer alice", http.StatusUnauthorized, ""},
+		{"wrong token", "Bearer other", http.StatusUnauthorized, ""},
+		{"empty token", "Bearer ", http.StatusUnauthorized, ""},
+		{"no header", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/status", nil)
+			r.Header.Set("X-Actor", "mallory")
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && w.Body.String() != tt.wantActor {
+				t.Fatalf("actor = %q, want %q", w.Body.String(), tt.wantActor)
+			}
+		})
+	}
+}
+
+func TestServerLeavesProbesOpen(t *testing.T) {
+	s := NewServer("0", nil, 0, nil, nil, nil, nil)
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/delivery-attempts", http.StatusUnauthorized},
+		{"/failed-messages/1", http.StatusUnauthorized},
+		{"/consumer/pause", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
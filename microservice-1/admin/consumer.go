@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+)
+
+// manualPause is the pause reason of operators pausing the consumer.
+const manualPause = "manual"
+
+// ConsumerState is the response body of /consumer.
+type ConsumerState struct {
+	Paused    bool     `json:"paused"`
+	PausedFor []string `json:"paused_for"` // e.g. "manual", "circuit-open:<destination>" or "backpressure:<watermark>"
+}
+
+// handleConsumer serves the consumer state and manual pausing:
+//
+//	GET  /consumer         whether and why consumption is paused
+//	POST /consumer/pause   pause consumption until resumed through the API
+//	POST /consumer/resume  lift a pause made through the API
+//
+// Resuming only lifts the manual pause; consumption stays paused while an
+// open circuit or backpressure pauses it too.
+func (s *Server) handleConsumer(w http.ResponseWriter, r *http.Request) {
+	switch action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/consumer"), "/"); action {
+	case "":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+	case "pause", "resume":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if action == "pause" {
+			s.Consumer.Pause(manualPause)
+		} else {
+			s.Consumer.Resume(manualPause)
+		}
+		s.audit(r, "consumer-"+action, nil, "ok")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	reasons := s.Consumer.PauseReasons()
+	writeJSON(w, http.StatusOK, ConsumerState{Paused: len(reasons) > 0, PausedFor: reasons})
+}
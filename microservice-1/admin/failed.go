@@ -0,0 +1,330 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"microservice-1/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the failed message list and of batch replays.
+const (
+	defaultListLimit   = 100
+	defaultReplayLimit = 100
+	maxLimit           = 1000
+)
+
+// FailedMessage is the JSON encoding of a persisted failed message.
+type FailedMessage struct {
+	ID          int64             `json:"id"`
+	Route       string            `json:"route"`
+	Destination string            `json:"destination"`
+	Topic       string            `json:"topic"`
+	Partition   int               `json:"partition"`
+	Offset      int64             `json:"offset"`
+	Key         string            `json:"key,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Message     string            `json:"message"`
+	Attempts    int               `json:"attempts"`
+	LastError   string            `json:"last_error"`
+	Permanent   bool              `json:"permanent"`
+	History     []db.Attempt      `json:"history,omitempty"` // Only when fetched by id
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+func newFailedMessage(msg db.FailedMessage, withHistory bool) FailedMessage {
+	m := FailedMessage{
+		ID:          msg.ID,
+		Route:       msg.Route,
+		Destination: msg.Destination,
+		Topic:       msg.Message.Topic,
+		Partition:   msg.Message.Partition,
+		Offset:      msg.Message.Offset,
+		Key:         string(msg.Message.Key),
+		Message:     string(msg.Message.Value),
+		Attempts:    msg.Attempts,
+		LastError:   msg.LastError,
+		Permanent:   msg.Permanent,
+		CreatedAt:   msg.CreatedAt,
+		UpdatedAt:   msg.UpdatedAt,
+	}
+	if len(msg.Message.Headers) > 0 {
+		m.Headers = make(map[string]string, len(msg.Message.Headers))
+		for _, h := range msg.Message.Headers {
+			m.Headers[h.Key] = string(h.Value)
+		}
+	}
+	if withHistory {
+		m.History = msg.History
+		if m.History == nil {
+			m.History = []db.Attempt{}
+		}
+	}
+	return m
+}
+
+// ReplayResult is the outcome of replaying one failed message.
+type ReplayResult struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"` // "replayed" or "failed"
+	Error  string `json:"error,omitempty"`
+}
+
+// handleFailedMessages serves the failed message collection:
+//
+//	GET    /failed-messages         list, filtered by the query, see parseFilter
+//	POST   /failed-messages/replay  replay the messages selected by the query
+//	DELETE /failed-messages         purge the messages selected by the query
+//	GET    /failed-messages/{id}    one message with its attempt history
+//	GET    /failed-messages/{id}/attempts  every delivery attempt of the message
+//	POST   /failed-messages/{id}/replay
+//	DELETE /failed-messages/{id}
+func (s *Server) handleFailedMessages(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/failed-messages"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		switch r.Method {
+		case http.MethodGet:
+			s.listFailedMessages(w, r)
+		case http.MethodDelete:
+			s.purgeFailedMessages(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case path == "replay":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		s.replayFailedMessages(w, r)
+	default:
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "replay" && parts[1] != "attempts") {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 2 && parts[1] == "attempts" && r.Method == http.MethodGet:
+			s.getFailedMessageAttempts(w, id)
+		case len(parts) == 2 && parts[1] == "attempts":
+			methodNotAllowed(w, http.MethodGet)
+		case len(parts) == 2 && r.Method == http.MethodPost:
+			s.replayFailedMessage(w, r, id)
+		case len(parts) == 2:
+			methodNotAllowed(w, http.MethodPost)
+		case r.Method == http.MethodGet:
+			s.getFailedMessage(w, id)
+		case r.Method == http.MethodDelete:
+			s.deleteFailedMessage(w, r, id)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	}
+}
+
+func (s *Server) listFailedMessages(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r, defaultListLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := s.DB.ListFailedMessages(filter)
+	if err != nil {
+		log.Printf("Failed to list failed messages: %v", err)
+		http.Error(w, "Failed to list failed messages", http.StatusInternalServerError)
+		return
+	}
+	result := make([]FailedMessage, len(messages))
+	for i, msg := range messages {
+		result[i] = newFailedMessage(msg, false)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getFailedMessage(w http.ResponseWriter, id int64) {
+	msg, err := s.DB.GetFailedMessage(id)
+	if err != nil {
+		log.Printf("Failed to load failed message %d: %v", id, err)
+		http.Error(w, "Failed to load failed message", http.StatusInternalServerError)
+		return
+	}
+	if msg == nil {
+		http.Error(w, "Failed message not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newFailedMessage(*msg, true))
+}
+
+// replayFailedMessage claims and replays one message, whether or not it
+// failed permanently, and answers 200 with its ReplayResult, or 409 if the
+// message is being replayed already.
+func (s *Server) replayFailedMessage(w http.ResponseWriter, r *http.Request, id int64) {
+	msg, err := s.DB.ClaimFailedMessage(id, s.replayLease)
+	if errors.Is(err, db.ErrClaimed) {
+		http.Error(w, "Failed message is being replayed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to claim failed message %d: %v", id, err)
+		http.Error(w, "Failed to claim failed message", http.StatusInternalServerError)
+		return
+	}
+	if msg == nil {
+		http.Error(w, "Failed message not found", http.StatusNotFound)
+		return
+	}
+	result := s.replay(r, *msg)
+	s.audit(r, "replay", map[string]int64{"id": id}, result.Status)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// replayFailedMessages claims the messages selected by the query and
+// replays them one after the other, at most limit (default 100) of them.
+// Messages being replayed by someone else are skipped.
+func (s *Server) replayFailedMessages(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r, defaultReplayLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := s.DB.ClaimFailedMessages(filter, s.replayLease)
+	if err != nil {
+		log.Printf("Failed to claim failed messages: %v", err)
+		http.Error(w, "Failed to claim failed messages", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]ReplayResult, 0, len(messages))
+	replayed := 0
+	for i, msg := range messages {
+		if r.Context().Err() != nil {
+			s.release(messages[i:])
+			break
+		}
+		result := s.replay(r, msg)
+		if result.Status == "replayed" {
+			replayed++
+		}
+		results = append(results, result)
+	}
+	s.audit(r, "replay", r.URL.Query(), fmt.Sprintf("%d of %d replayed", replayed, len(messages)))
+	writeJSON(w, http.StatusOK, results)
+}
+
+// replay replays msg through the retry handler.
+func (s *Server) replay(r *http.Request, msg db.FailedMessage) ReplayResult {
+	if err := s.RetryHandler.Replay(r.Context(), msg); err != nil {
+		return ReplayResult{ID: msg.ID, Status: "failed", Error: err.Error()}
+	}
+	return ReplayResult{ID: msg.ID, Status: "replayed"}
+}
+
+// release ends the claims on messages that were not replayed.
+func (s *Server) release(messages []db.FailedMessage) {
+	for _, msg := range messages {
+		if err := s.DB.ReleaseFailedMessage(msg.ID); err != nil {
+			log.Printf("Failed to release failed message %d: %v", msg.ID, err)
+		}
+	}
+}
+
+func (s *Server) deleteFailedMessage(w http.ResponseWriter, r *http.Request, id int64) {
+	deleted, err := s.DB.DeleteFailedMessage(id)
+	if err != nil {
+		log.Printf("Failed to delete failed message %d: %v", id, err)
+		http.Error(w, "Failed to delete failed message", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Failed message not found", http.StatusNotFound)
+		return
+	}
+	s.audit(r, "purge", map[string]int64{"id": id}, "deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeFailedMessages deletes the messages selected by the query. Deleting
+// every message requires all=true so that a forgotten filter does not wipe
+// the table.
+func (s *Server) purgeFailedMessages(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.IsZero() && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "A filter or all=true is required", http.StatusBadRequest)
+		return
+	}
+	deleted, err := s.DB.DeleteFailedMessages(filter)
+	if err != nil {
+		log.Printf("Failed to purge failed messages: %v", err)
+		http.Error(w, "Failed to purge failed messages", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, "purge", r.URL.Query(), fmt.Sprintf("%d deleted", deleted))
+	writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+// parseFilter reads a FailedMessageFilter from the query parameters since
+// and until (RFC 3339), route, error, permanent, limit and offset.
+func parseFilter(r *http.Request, defaultLimit int) (db.FailedMessageFilter, error) {
+	query := r.URL.Query()
+	filter := db.FailedMessageFilter{
+		Route: query.Get("route"),
+		Error: query.Get("error"),
+		Limit: defaultLimit,
+	}
+	var err error
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if v := query.Get("permanent"); v != "" {
+		permanent, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid permanent: %v", err)
+		}
+		filter.Permanent = &permanent
+	}
+	if v := query.Get("limit"); v != "" && defaultLimit > 0 {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			return filter, fmt.Errorf("invalid limit, must be between 1 and %d", maxLimit)
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("invalid offset")
+		}
+	}
+	return filter, nil
+}
+
+// audit logs an admin action and records it in admin_audit_log. The actor
+// is the one the bearer token of the request belongs to.
+func (s *Server) audit(r *http.Request, action string, params interface{}, result string) {
+	actor := actor(r)
+	log.Printf("Admin action %s by %s (%v): %s", action, actor, params, result)
+	err := s.DB.RecordAdminAction(db.AdminAction{Actor: actor, Action: action, Params: params, Result: result})
+	if err != nil {
+		log.Printf("Failed to record admin action %s by %s: %v", action, actor, err)
+	}
+}
+
+// methodNotAllowed answers 405 listing the allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,148 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"microservice-1/db"
+	"microservice-1/queue"
+	"microservice-1/retry"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds each dependency check done by /readyz.
+const readyTimeout = 2 * time.Second
+
+// Server is the admin and health HTTP server of Microservice-1. The health
+// probes and handlers added with Handle are open; every other endpoint
+// requires one of the configured bearer tokens.
+type Server struct {
+	Consumer     *queue.Consumer
+	DB           *db.DB
+	RetryHandler *retry.RetryHandler
+	Router       *retry.Router
+
+	tokens      map[string]string // Actor -> bearer token
+	replayLease time.Duration     // Time a replay through the API holds the messages it claimed
+	mux         *http.ServeMux
+	server      *http.Server
+}
+
+// NewServer initializes a new Server instance listening on port. tokens maps
+// the name of each actor, recorded in the audit log, to the bearer token it
+// authenticates with.
+func NewServer(port string, tokens map[string]string, replayLease time.Duration, consumer *queue.Consumer, database *db.DB, retryHandler *retry.RetryHandler, router *retry.Router) *Server {
+	s := &Server{
+		Consumer:     consumer,
+		DB:           database,
+		RetryHandler: retryHandler,
+		Router:       router,
+		tokens:       tokens,
+		replayLease:  replayLease,
+		mux:          http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/failed-messages", s.authenticate(s.handleFailedMessages))
+	s.mux.HandleFunc("/failed-messages/", s.authenticate(s.handleFailedMessages))
+	s.mux.HandleFunc("/delivery-attempts", s.authenticate(s.handleDeliveryAttempts))
+	s.mux.HandleFunc("/consumer", s.authenticate(s.handleConsumer))
+	s.mux.HandleFunc("/consumer/", s.authenticate(s.handleConsumer))
+	s.server = &http.Server{Addr: ":" + port, Handler: s.mux}
+	return s
+}
+
+// Handle registers an additional handler on the admin server. It is not
+// authenticated.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start runs the HTTP server until Shutdown is called.
+func (s *Server) Start() {
+	log.Printf("Starting admin server on %s...", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops the HTTP server, waiting for active requests until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// handleHealthz reports that the process is alive.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the queue backend and Postgres are reachable.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"queue":    s.Consumer.Ping,
+		"postgres": s.DB.Ping,
+	}
+
+	status := http.StatusOK
+	result := make(map[string]string, len(checks))
+	for name, check := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		err := check(ctx)
+		cancel()
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			result[name] = err.Error()
+			continue
+		}
+		result[name] = "ok"
+	}
+	writeJSON(w, status, result)
+}
+
+// Status is the response body of /status.
+type Status struct {
+	InFlight      int64             `json:"in_flight"`
+	Unacked       int               `json:"unacked"`
+	Retrying      int64             `json:"retrying"`
+	FailedPending int               `json:"failed_pending"`
+	RetryJobs     int               `json:"retry_jobs"` // Retries waiting in retry_jobs, see RETRY_SCHEDULER
+	ConsumerLag   int64             `json:"consumer_lag"`
+	Circuits      map[string]string `json:"circuits"` // Circuit breaker state per route
+	PausedFor     []string          `json:"paused_for"`
+}
+
+// handleStatus reports the state of the relay.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		InFlight:      s.RetryHandler.InFlight(),
+		Unacked:       s.Consumer.Unacked(),
+		Retrying:      s.RetryHandler.Retrying(),
+		FailedPending: -1,
+		RetryJobs:     -1,
+		ConsumerLag:   s.Consumer.Lag(),
+		Circuits:      s.Router.CircuitStates(),
+		PausedFor:     s.Consumer.PauseReasons(),
+	}
+	if pending, err := s.DB.CountPendingMessages(); err != nil {
+		log.Printf("Failed to count failed messages: %v", err)
+	} else {
+		status.FailedPending = pending
+	}
+	if jobs, err := s.DB.CountRetryJobs(); err != nil {
+		log.Printf("Failed to count retry jobs: %v", err)
+	} else {
+		status.RetryJobs = jobs
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"microservice-1/config"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// Closed lets every call through and counts consecutive failures.
+	Closed State = iota
+	// Open rejects every call until the probe interval has passed.
+	Open
+	// HalfOpen lets a single probe call through at a time to test whether
+	// the downstream service has recovered.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrOpen is returned by Allow while the circuit rejects calls.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Breaker is a circuit breaker guarding calls to a downstream service.
+type Breaker struct {
+	name             string
+	failureThreshold int
+	successThreshold int
+	probeInterval    time.Duration
+
+	mu        sync.Mutex
+	state     State
+	failures  int // Consecutive failures while closed
+	successes int // Consecutive successful probes while half-open
+	probing   bool
+	changed   chan struct{} // Closed and replaced on every state change or freed probe slot
+	listeners []func(from, to State)
+	pending   []transition // State changes not yet reported to listeners
+	notifying bool         // Whether a caller is reporting pending to listeners
+}
+
+// transition is a state change waiting to be reported to listeners.
+type transition struct {
+	from, to State
+}
+
+// New returns a closed breaker. name is only used in log messages.
+func New(name string, config config.BreakerConfig) *Breaker {
+	failureThreshold := config.FailureThreshold
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	successThreshold := config.SuccessThreshold
+	if successThreshold < 1 {
+		successThreshold = 1
+	}
+	return &Breaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		successThreshold: successThreshold,
+		probeInterval:    config.ProbeInterval,
+		changed:          make(chan struct{}),
+	}
+}
+
+// OnStateChange registers fn to be called after every state transition. fn
+// runs synchronously once the breaker is unlocked, so it may call back into
+// the breaker, e.g. to read its State.
+func (b *Breaker) OnStateChange(fn func(from, to State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, fn)
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a call may proceed. Every call that was allowed must
+// be followed by exactly one Success, Failure or Release.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Closed:
+		return nil
+	case HalfOpen:
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return ErrOpen
+	}
+}
+
+// Success records a successful call.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.unlock()
+
+	switch b.state {
+	case Closed:
+		b.failures = 0
+	case HalfOpen:
+		b.probing = false
+		b.successes++
+		if b.successes >= b.successThreshold {
+			b.setState(Closed)
+		}
+	}
+}
+
+// Failure records a failed call.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.unlock()
+
+	switch b.state {
+	case Closed:
+		b.failures++
+		if b.failures >= b.failureThreshold {
+			b.open()
+		}
+	case HalfOpen:
+		b.probing = false
+		b.open()
+	}
+}
+
+// Release ends an allowed call without recording a result, e.g. because the
+// caller gave up before the downstream service answered.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HalfOpen && b.probing {
+		b.probing = false
+		// Wake up callers waiting for the probe slot.
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
+
+// Wait blocks while Allow would return ErrOpen, until the breaker changes
+// state, a probe slot is freed or ctx is done, so that a rejected caller can
+// try again.
+func (b *Breaker) Wait(ctx context.Context) {
+	b.mu.Lock()
+	changed := b.changed
+	rejecting := b.state == Open || (b.state == HalfOpen && b.probing)
+	b.mu.Unlock()
+
+	if rejecting {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// open trips the breaker and schedules the move to half-open after the probe
+// interval. b.mu must be held.
+func (b *Breaker) open() {
+	b.setState(Open)
+	time.AfterFunc(b.probeInterval, func() {
+		b.mu.Lock()
+		defer b.unlock()
+		if b.state == Open {
+			b.setState(HalfOpen)
+		}
+	})
+}
+
+// setState moves to state and resets the counters. Listeners are notified
+// by unlock. b.mu must be held.
+func (b *Breaker) setState(state State) {
+	from := b.state
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	b.probing = false
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	log.Printf("Circuit breaker %s: %s -> %s\n", b.name, from, state)
+	b.pending = append(b.pending, transition{from: from, to: state})
+}
+
+// unlock releases b.mu and then reports pending state changes to the
+// listeners, so that they can neither deadlock on the breaker nor delay
+// callers that only need the lock. Only one caller reports at a time, which
+// keeps the transitions in order; changes made meanwhile are picked up by
+// that caller.
+func (b *Breaker) unlock() {
+	if b.notifying {
+		b.mu.Unlock()
+		return
+	}
+	b.notifying = true
+	for len(b.pending) > 0 {
+		pending := b.pending
+		b.pending = nil
+		listeners := b.listeners
+		b.mu.Unlock()
+
+		for _, t := range pending {
+			for _, fn := range listeners {
+				fn(t.from, t.to)
+			}
+		}
+		b.mu.Lock()
+	}
+	b.notifying = false
+	b.mu.Unlock()
+}
@@ -0,0 +1,122 @@
+package breaker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"microservice-1/config"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls string // s = success, f = failure, w = wait for the probe interval
+		want  State
+	}{
+		{"stays closed below the threshold", "ff", Closed},
+		{"success resets the failure count", "ffsff", Closed},
+		{"opens at the threshold", "fff", Open},
+		{"half-open after the probe interval", "fffw", HalfOpen},
+		{"failed probe opens again", "fffwf", Open},
+		{"first successful probe stays half-open", "fffws", HalfOpen},
+		{"closes after enough successful probes", "fffwss", Closed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("test", config.BreakerConfig{
+				FailureThreshold: 3,
+				SuccessThreshold: 2,
+				ProbeInterval:    10 * time.Millisecond,
+			})
+			for _, call := range tt.calls {
+				switch call {
+				case 's':
+					if err := b.Allow(); err != nil {
+						t.Fatalf("Allow() = %v in state %s", err, b.State())
+					}
+					b.Success()
+				case 'f':
+					if err := b.Allow(); err != nil {
+						t.Fatalf("Allow() = %v in state %s", err, b.State())
+					}
+					b.Failure()
+				case 'w':
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+					b.Wait(ctx)
+					cancel()
+				}
+			}
+			if got := b.State(); got != tt.want {
+				t.Fatalf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerAllowsOneProbe(t *testing.T) {
+	b := New("test", config.BreakerConfig{FailureThreshold: 1, SuccessThreshold: 1, ProbeInterval: time.Millisecond})
+	b.Allow()
+	b.Failure()
+	if err := b.Allow(); err != ErrOpen {
+		t.Fatalf("Allow() while open = %v, want ErrOpen", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b.Wait(ctx)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("first probe: Allow() = %v", err)
+	}
+	if err := b.Allow(); err != ErrOpen {
+		t.Fatalf("second probe: Allow() = %v, want ErrOpen", err)
+	}
+	b.Release()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe after Release: Allow() = %v", err)
+	}
+}
+
+func TestBreakerNotifiesListenersUnlocked(t *testing.T) {
+	b := New("test", config.BreakerConfig{FailureThreshold: 1, SuccessThreshold: 1, ProbeInterval: time.Millisecond})
+
+	var mu sync.Mutex
+	var got []State
+	done := make(chan struct{})
+	b.OnStateChange(func(from, to State) {
+		// Calling back into the breaker must not deadlock
+		b.State()
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, to)
+		if to == Closed {
+			close(done)
+		}
+	})
+
+	b.Allow()
+	b.Failure()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b.Wait(ctx)
+	b.Allow()
+	b.Success()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener was not told about the circuit closing")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []State{Open, HalfOpen, Closed}
+	if len(got) != len(want) {
+		t.Fatalf("transitions = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", got, want)
+		}
+	}
+}
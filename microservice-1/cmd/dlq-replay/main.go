@@ -0,0 +1,94 @@
+// Command dlq-replay re-publishes records from the dead-letter topic back to
+// the main topic, restoring their original key and headers. Replayed records
+// carry the x-relay-destination header, so Microservice-1 only delivers them
+// to the destination that failed.
+//
+// Defaults come from the same environment variables as Microservice-1:
+//
+//	go run ./cmd/dlq-replay -max 100
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"microservice-1/config"
+	"microservice-1/queue"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func main() {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	broker := flag.String("broker", cfg.QueueConfig.Broker, "Kafka broker address")
+	dlqTopic := flag.String("dlq-topic", cfg.QueueConfig.DeadLetterTopic, "dead-letter topic to read from")
+	topic := flag.String("topic", cfg.QueueConfig.Topic, "topic to re-publish to")
+	groupID := flag.String("group", cfg.QueueConfig.GroupID+"-dlq-replay", "consumer group used to read the dead-letter topic")
+	max := flag.Int("max", 0, "stop after re-publishing this many records (0 for no limit)")
+	idle := flag.Duration("idle", 10*time.Second, "stop once no record arrived for this long")
+	flag.Parse()
+
+	if *dlqTopic == "" {
+		log.Fatal("No dead-letter topic: set QUEUE_DLQ_TOPIC or -dlq-topic")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{*broker},
+		Topic:   *dlqTopic,
+		GroupID: *groupID,
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(*broker),
+		Topic:        *topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	log.Printf("Re-publishing from %s to %s...", *dlqTopic, *topic)
+	count := 0
+	for *max == 0 || count < *max {
+		fetchCtx, cancel := context.WithTimeout(ctx, *idle)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				log.Printf("No record for %v, assuming the dead-letter topic is drained", *idle)
+				break
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			log.Fatalf("Error reading dead-letter record: %v", err)
+		}
+
+		// Write before committing so that a crash re-publishes at worst twice
+		err = writer.WriteMessages(ctx, kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: queue.ReplayHeaders(msg.Headers),
+		})
+		if err != nil {
+			log.Fatalf("Error re-publishing offset %d: %v", msg.Offset, err)
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			log.Fatalf("Error committing offset %d: %v", msg.Offset, err)
+		}
+		count++
+	}
+	log.Printf("Re-published %d records", count)
+}
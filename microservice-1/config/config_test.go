@@ -0,0 +1,89 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"memory backend without broker", func(c *Config) { c.QueueConfig.Backend = "memory"; c.QueueConfig.Broker = "" }, ""},
+		{"kafka backend without broker", func(c *Config) { c.QueueConfig.Broker = "" }, "QUEUE_BROKER: must not be empty"},
+		{"unknown backend", func(c *Config) { c.QueueConfig.Backend = "rabbit" }, "QUEUE_BACKEND: must be one of kafka, memory, file"},
+		{"target not http", func(c *Config) { c.RetryConfig.TargetURL = "ftp://host/data" }, "RETRY_TARGET_URL: must be an http or https URL"},
+		{"max delay below delay", func(c *Config) { c.RetryConfig.Backoff = "exponential"; c.RetryConfig.MaxDelay = time.Second }, "RETRY_MAX_DELAY"},
+		{"lease below timeout", func(c *Config) { c.RetryConfig.SchedulerLease = c.RetryConfig.Timeout }, "RETRY_SCHEDULER_LEASE"},
+		{"same ports", func(c *Config) { c.IngressPort = c.AdminPort }, "INGRESS_PORT: must differ from ADMIN_PORT"},
+		{"invalid port", func(c *Config) { c.AdminPort = "http" }, "ADMIN_PORT: must be a port number"},
+		{"admin token", func(c *Config) { c.AdminTokens = map[string]string{"alice": "s3cret"} }, ""},
+		{"admin actor without token", func(c *Config) { c.AdminTokens = map[string]string{"alice": "alice"} }, "ADMIN_TOKENS: must map each actor to a token"},
+		{"shared admin token", func(c *Config) { c.AdminTokens = map[string]string{"alice": "s3cret", "bob": "s3cret"} }, "share a token"},
+		{"in-flight watermarks", func(c *Config) { c.Backpressure.InFlightHigh = 100; c.Backpressure.InFlightLow = 100 }, "BACKPRESSURE_IN_FLIGHT_LOW: must be less than"},
+		{"in-flight high without low", func(c *Config) { c.Backpressure.InFlightHigh = 100 }, "BACKPRESSURE_IN_FLIGHT_LOW: must be -1 exactly when"},
+		{"in-flight disabled", func(c *Config) { c.Backpressure.InFlightHigh = 0 }, ""},
+		{"key without signing id", func(c *Config) { c.RetryConfig.HTTP.SigningSecret = "s"; c.RetryConfig.HTTP.SigningKeyID = "" }, "SIGNING_KEY_ID"},
+		{"several errors", func(c *Config) { c.WorkerConfig.PoolSize = 0; c.TracingConfig.Exporter = "file" }, "WORKER_POOL_SIZE: must be positive\nTRACING_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaults()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	cfg := defaults()
+	cfg.DatabaseURL = "host=db user=relay password=pw dbname=retry_db"
+	cfg.IngressToken = "ingress-secret"
+	cfg.AdminTokens = map[string]string{"alice": "admin-secret"}
+	got := cfg.Redacted()
+	for _, secret := range []string{"pw", "ingress-secret", "admin-secret"} {
+		if strings.Contains(got, secret) {
+			t.Fatalf("Redacted() contains %q:\n%s", secret, got)
+		}
+	}
+}
+
+func TestInFlightWatermarks(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(*Config)
+		batching bool
+		wantHigh int
+		wantLow  int
+	}{
+		{"derived", func(c *Config) {}, false, 20, 10},
+		{"derived with batching", func(c *Config) {}, true, 1020, 510},
+		{"derived with scheduler", func(c *Config) { c.RetryConfig.Scheduler = "postgres" }, false, 24, 12},
+		{"derived from pool size", func(c *Config) { c.WorkerConfig.PoolSize = 50 }, false, 60, 30},
+		{"fixed", func(c *Config) { c.Backpressure.InFlightHigh = 8; c.Backpressure.InFlightLow = 2 }, true, 8, 2},
+		{"disabled", func(c *Config) { c.Backpressure.InFlightHigh = 0 }, true, 0, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaults()
+			tt.change(&cfg)
+			high, low := cfg.InFlightWatermarks(tt.batching)
+			if high != tt.wantHigh || low != tt.wantLow {
+				t.Fatalf("InFlightWatermarks() = %d, %d, want %d, %d", high, low, tt.wantHigh, tt.wantLow)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"shared/layers"
+)
+
+// Duration is a time.Duration read from JSON as a string such as "10s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RetryPolicy is the retry policy of a route. Zero fields are inherited from
+// the RETRY_* environment variables.
+type RetryPolicy struct {
+	Backoff     string   `json:"backoff"`      // fixed, exponential or decorrelated
+	Delay       Duration `json:"delay"`        // Fixed delay, or the initial/base delay of the other strategies
+	MaxDelay    Duration `json:"max_delay"`    // Upper bound for exponential and decorrelated delays
+	MaxElapsed  Duration `json:"max_elapsed"`  // Give up once retrying would take longer than this
+	MaxAttempts int      `json:"max_attempts"` // Delivery attempts before a message is persisted
+}
+
+// Policy returns the retry policy set by the RETRY_* environment variables.
+func (c RetryConfig) Policy() RetryPolicy {
+	return RetryPolicy{
+		Backoff:     c.Backoff,
+		Delay:       Duration(c.RetryDelay),
+		MaxDelay:    Duration(c.MaxDelay),
+		MaxElapsed:  Duration(c.MaxElapsed),
+		MaxAttempts: c.MaxAttempts,
+	}
+}
+
+// Inherit returns p with its zero fields taken from defaults.
+func (p RetryPolicy) Inherit(defaults RetryPolicy) RetryPolicy {
+	if p.Backoff == "" {
+		p.Backoff = defaults.Backoff
+	}
+	if p.Delay == 0 {
+		p.Delay = defaults.Delay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaults.MaxDelay
+	}
+	if p.MaxElapsed == 0 {
+		p.MaxElapsed = defaults.MaxElapsed
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	return p
+}
+
+// BatchConfig enables batched delivery: messages are POSTed as a JSON array
+// to URL instead of one request per message. Zero size limits are
+// inherited; URL never is, since it belongs to one target.
+type BatchConfig struct {
+	URL         string   `json:"url"`          // Bulk endpoint; empty disables batching
+	MaxMessages int      `json:"max_messages"` // Flush once a batch holds this many messages
+	MaxBytes    int      `json:"max_bytes"`    // Flush once the message payloads add up to this many bytes
+	Linger      Duration `json:"linger"`       // Flush a batch this long after its first message at the latest
+}
+
+// Batch returns the batching settings of the RETRY_BATCH_* environment variables.
+func (c RetryConfig) Batch() BatchConfig {
+	return BatchConfig{
+		URL:         c.BatchURL,
+		MaxMessages: c.BatchMaxMessages,
+		MaxBytes:    c.BatchMaxBytes,
+		Linger:      Duration(c.BatchLinger),
+	}
+}
+
+// Inherit returns b with its zero size limits taken from defaults.
+func (b BatchConfig) Inherit(defaults BatchConfig) BatchConfig {
+	if b.MaxMessages == 0 {
+		b.MaxMessages = defaults.MaxMessages
+	}
+	if b.MaxBytes == 0 {
+		b.MaxBytes = defaults.MaxBytes
+	}
+	if b.Linger == 0 {
+		b.Linger = defaults.Linger
+	}
+	return b
+}
+
+// MatchConfig selects the messages of a route. Every condition that is set
+// must hold.
+type MatchConfig struct {
+	Topic  string            `json:"topic"`  // Kafka topic
+	Header map[string]string `json:"header"` // Kafka header name -> value
+	Field  map[string]string `json:"field"`  // Dot-separated JSON path in the message -> value
+}
+
+// DestinationConfig is one of several targets a route fans out to. Each
+// destination is retried, circuit-broken and dead-lettered on its own.
+type DestinationConfig struct {
+	Name      string      `json:"name"`
+	TargetURL string      `json:"target_url"`
+	Timeout   Duration    `json:"timeout"`  // Zero inherits the timeout of the route
+	Retry     RetryPolicy `json:"retry"`    // Zero fields inherit the policy of the route
+	Batch     BatchConfig `json:"batch"`    // Zero size limits inherit the limits of the route
+	Optional  bool        `json:"optional"` // Commit offsets without waiting for this destination
+}
+
+// RouteConfig is one entry of the routing table. A route delivers either to
+// TargetURL or to every entry of Destinations.
+type RouteConfig struct {
+	Name         string              `json:"name"`
+	Match        MatchConfig         `json:"match"`
+	TargetURL    string              `json:"target_url"`
+	Destinations []DestinationConfig `json:"destinations"`
+	Timeout      Duration            `json:"timeout"` // Per-request timeout; zero inherits RETRY_TIMEOUT
+	Retry        RetryPolicy         `json:"retry"`
+	Batch        BatchConfig         `json:"batch"`
+}
+
+// RoutesConfig is the content of the routes file. Routes are tried in order
+// and the first match wins; messages matching none go to Default, which
+// falls back to RETRY_TARGET_URL when omitted.
+type RoutesConfig struct {
+	Routes  []RouteConfig `json:"routes"`
+	Default *RouteConfig  `json:"default"`
+}
+
+// LoadRoutes reads and validates a routes file.
+func LoadRoutes(path string) (RoutesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RoutesConfig{}, err
+	}
+
+	var routes RoutesConfig
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return RoutesConfig{}, fmt.Errorf("invalid routes file %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i, route := range routes.Routes {
+		if route.Name == "" {
+			return RoutesConfig{}, fmt.Errorf("route %d has no name", i)
+		}
+		if names[route.Name] || route.Name == DefaultRouteName {
+			return RoutesConfig{}, fmt.Errorf("duplicate route name %q", route.Name)
+		}
+		names[route.Name] = true
+		if err := validateTargets(route); err != nil {
+			return RoutesConfig{}, err
+		}
+		if route.Match.Topic == "" && len(route.Match.Header) == 0 && len(route.Match.Field) == 0 {
+			return RoutesConfig{}, fmt.Errorf("route %q has no match conditions", route.Name)
+		}
+	}
+	if routes.Default != nil {
+		if routes.Default.Name == "" {
+			routes.Default.Name = DefaultRouteName
+		}
+		validate := checkURLs
+		if len(routes.Default.Destinations) > 0 {
+			validate = validateTargets
+		}
+		if err := validate(*routes.Default); err != nil {
+			return RoutesConfig{}, err
+		}
+	}
+	return routes, nil
+}
+
+// validateTargets checks that route has either a target_url (or batch url)
+// or a list of uniquely named destinations with one, see also checkURLs.
+func validateTargets(route RouteConfig) error {
+	if err := checkURLs(route); err != nil {
+		return err
+	}
+	if len(route.Destinations) == 0 {
+		if route.TargetURL == "" && route.Batch.URL == "" {
+			return fmt.Errorf("route %q has neither target_url nor destinations", route.Name)
+		}
+		return nil
+	}
+	if route.TargetURL != "" || route.Batch.URL != "" {
+		return fmt.Errorf("route %q has both a target URL and destinations", route.Name)
+	}
+
+	names := make(map[string]bool)
+	for i, destination := range route.Destinations {
+		if destination.Name == "" {
+			return fmt.Errorf("destination %d of route %q has no name", i, route.Name)
+		}
+		if names[destination.Name] {
+			return fmt.Errorf("duplicate destination %q in route %q", destination.Name, route.Name)
+		}
+		names[destination.Name] = true
+		if destination.TargetURL == "" && destination.Batch.URL == "" {
+			return fmt.Errorf("destination %q of route %q has no target_url", destination.Name, route.Name)
+		}
+	}
+	return nil
+}
+
+// checkURLs checks that the target and batch URLs of route and its
+// destinations are absolute HTTP(S) URLs where set.
+func checkURLs(route RouteConfig) error {
+	var v layers.Validator
+	v.CheckURL(route.TargetURL, fmt.Sprintf("target_url of route %q", route.Name))
+	v.CheckURL(route.Batch.URL, fmt.Sprintf("batch url of route %q", route.Name))
+	for _, destination := range route.Destinations {
+		v.CheckURL(destination.TargetURL, fmt.Sprintf("target_url of destination %q of route %q", destination.Name, route.Name))
+		v.CheckURL(destination.Batch.URL, fmt.Sprintf("batch url of destination %q of route %q", destination.Name, route.Name))
+	}
+	return v.Err()
+}
+
+// DefaultRouteName is the name of the route used when no other route matches.
+const DefaultRouteName = "default"
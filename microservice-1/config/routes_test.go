@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  string
+		wantErr string
+	}{
+		{"target", `{"routes": [{"name": "orders", "match": {"topic": "orders"}, "target_url": "http://orders:8080/api/data"}]}`, ""},
+		{"destinations", `{"routes": [{"name": "orders", "match": {"topic": "orders"}, "destinations": [{"name": "a", "target_url": "https://a/api"}, {"name": "b", "batch": {"url": "http://b/bulk"}}]}]}`, ""},
+		{"no match", `{"routes": [{"name": "orders", "target_url": "http://orders:8080/api/data"}]}`, `route "orders" has no match conditions`},
+		{"no target", `{"routes": [{"name": "orders", "match": {"topic": "orders"}}]}`, `route "orders" has neither target_url nor destinations`},
+		{"target not http", `{"routes": [{"name": "orders", "match": {"topic": "orders"}, "target_url": "htp://orders/api"}]}`, `target_url of route "orders": must be an http or https URL`},
+		{"target without scheme", `{"routes": [{"name": "orders", "match": {"topic": "orders"}, "target_url": "orders:8080/api"}]}`, `target_url of route "orders": must be an http or https URL`},
+		{"batch url without host", `{"routes": [{"name": "orders", "match": {"topic": "orders"}, "batch": {"url": "http:///bulk"}}]}`, `batch url of route "orders"`},
+		{"destination not http", `{"routes": [{"name": "orders", "match": {"topic": "orders"}, "destinations": [{"name": "a", "target_url": "a/api"}]}]}`, `target_url of destination "a" of route "orders"`},
+		{"default not http", `{"default": {"target_url": "ftp://fallback/api"}}`, `target_url of route "default"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			if err := os.WriteFile(path, []byte(tt.routes), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadRoutes(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadRoutes() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadRoutes() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
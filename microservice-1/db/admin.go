@@ -0,0 +1,213 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrClaimed is returned by ClaimFailedMessage for a message that another
+// replayer holds.
+var ErrClaimed = errors.New("failed message is being replayed")
+
+// unclaimed is the condition selecting failed messages nobody holds.
+const unclaimed = "(locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)"
+
+// FailedMessageFilter selects failed messages for the admin API. Zero
+// fields do not restrict the selection.
+type FailedMessageFilter struct {
+	Since     time.Time // Failed at or after
+	Until     time.Time // Failed before
+	Route     string
+	Error     string // Substring of the last error, case-insensitive
+	Permanent *bool
+	Limit     int // Maximum number of messages; zero means all
+	Offset    int
+}
+
+// IsZero reports whether f selects every failed message.
+func (f FailedMessageFilter) IsZero() bool {
+	return f.Since.IsZero() && f.Until.IsZero() && f.Route == "" && f.Error == "" && f.Permanent == nil
+}
+
+// where returns the WHERE clause of f, or "" if f selects everything, and
+// its arguments.
+func (f FailedMessageFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until)
+	}
+	if f.Route != "" {
+		add("route = $%d", f.Route)
+	}
+	if f.Error != "" {
+		add("last_error ILIKE '%%' || $%d || '%%'", escapeLike(f.Error))
+	}
+	if f.Permanent != nil {
+		add("permanent = $%d", *f.Permanent)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListFailedMessages returns the failed messages selected by filter, oldest
+// first.
+func (db *DB) ListFailedMessages(filter FailedMessageFilter) ([]FailedMessage, error) {
+	where, args := filter.where()
+	query := "SELECT " + failedMessageColumns + " FROM failed_messages" + where + " ORDER BY id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset > 0 {
+		args = append(args, filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []FailedMessage{}
+	for rows.Next() {
+		msg, err := scanFailedMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// GetFailedMessage returns the failed message with the given id, or nil if
+// there is none.
+func (db *DB) GetFailedMessage(id int64) (*FailedMessage, error) {
+	msg, err := scanFailedMessage(db.conn.QueryRow(
+		"SELECT "+failedMessageColumns+" FROM failed_messages WHERE id = $1", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ClaimFailedMessage claims the failed message with the given id for the
+// duration of lease, whether or not it failed permanently, and returns it.
+// It returns nil if there is no such message and ErrClaimed if another
+// replayer holds it. The claim ends as with ClaimPendingMessages.
+func (db *DB) ClaimFailedMessage(id int64, lease time.Duration) (*FailedMessage, error) {
+	msg, err := scanFailedMessage(db.conn.QueryRow(
+		`UPDATE failed_messages SET locked_until = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+		 WHERE id = $1 AND `+unclaimed+`
+		 RETURNING `+failedMessageColumns,
+		id, lease.Milliseconds(),
+	))
+	if err == nil {
+		return &msg, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	var exists bool
+	if err := db.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM failed_messages WHERE id = $1)", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrClaimed
+	}
+	return nil, nil
+}
+
+// ClaimFailedMessages claims the failed messages selected by filter that
+// nobody else holds for the duration of lease and returns them, oldest
+// first. Each claim ends as with ClaimPendingMessages.
+func (db *DB) ClaimFailedMessages(filter FailedMessageFilter, lease time.Duration) ([]FailedMessage, error) {
+	where, args := filter.where()
+	if where == "" {
+		where = " WHERE " + unclaimed
+	} else {
+		where += " AND " + unclaimed
+	}
+	query := "SELECT id FROM failed_messages" + where + " ORDER BY id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset > 0 {
+		args = append(args, filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	args = append(args, lease.Milliseconds())
+
+	rows, err := db.conn.Query(
+		fmt.Sprintf("UPDATE failed_messages SET locked_until = CURRENT_TIMESTAMP + $%d * INTERVAL '1 millisecond'", len(args))+
+			" WHERE id IN ("+query+" FOR UPDATE SKIP LOCKED) RETURNING "+failedMessageColumns,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanFailedMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// DeleteFailedMessages deletes the failed messages selected by filter,
+// ignoring its Limit and Offset, and returns how many were deleted.
+func (db *DB) DeleteFailedMessages(filter FailedMessageFilter) (int64, error) {
+	where, args := filter.where()
+	result, err := db.conn.Exec("DELETE FROM failed_messages"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// AdminAction is an entry of the audit log of the admin API.
+type AdminAction struct {
+	Actor  string      // Who made the request
+	Action string      // e.g. "replay" or "purge"
+	Params interface{} // Parameters of the action, stored as JSON
+	Result string      // Outcome, e.g. the number of affected messages
+}
+
+// RecordAdminAction appends an entry to admin_audit_log.
+func (db *DB) RecordAdminAction(action AdminAction) error {
+	params, err := json.Marshal(action.Params)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(
+		"INSERT INTO admin_audit_log (actor, action, params, result, created_at) VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)",
+		action.Actor, action.Action, params, action.Result,
+	)
+	return err
+}
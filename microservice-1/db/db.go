@@ -1,8 +1,13 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"log"
+	"microservice-1/queue"
+	"sort"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -11,6 +16,29 @@ type DB struct {
 	conn *sql.DB
 }
 
+// FailedMessage is a message that exhausted its delivery attempts and is
+// waiting to be replayed to its target.
+type FailedMessage struct {
+	ID          int64
+	Message     queue.Message
+	Route       string // Route the message was delivered on
+	Destination string // Destination of the route that failed
+	Attempts    int
+	LastError   string
+	Permanent   bool      // Failed with an error that retrying cannot fix; never replayed
+	History     []Attempt // Failed attempts, oldest first
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Attempt is one failed delivery attempt in the history of a message.
+type Attempt struct {
+	Number     int       `json:"number"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"` // HTTP status, zero if no response was received
+	Error      string    `json:"error"`
+}
+
 func NewDB(connStr string) *DB {
 	conn, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -19,25 +47,170 @@ func NewDB(connStr string) *DB {
 	return &DB{conn: conn}
 }
 
-func (db *DB) SaveFailedMessage(message string) error {
-	_, err := db.conn.Exec("INSERT INTO failed_messages (message) VALUES ($1)", message)
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
+}
+
+// Close closes the underlying connection pool.
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
+
+// SaveFailedMessage persists a message together with the number of attempts
+// already spent on it and the error returned by the last one. ID and the
+// timestamps of msg are ignored.
+func (db *DB) SaveFailedMessage(msg FailedMessage) error {
+	return saveFailedMessage(db.conn, msg)
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveFailedMessage inserts msg through conn, see SaveFailedMessage.
+func saveFailedMessage(conn execer, msg FailedMessage) error {
+	headers, err := json.Marshal(msg.Message.Headers)
+	if err != nil {
+		return err
+	}
+	history, err := marshalHistory(msg.History)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(
+		`INSERT INTO failed_messages (message, msg_key, headers, topic, kafka_partition, kafka_offset, route, destination, attempts, last_error, permanent, history, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		string(msg.Message.Value), msg.Message.Key, headers, msg.Message.Topic, msg.Message.Partition, msg.Message.Offset,
+		msg.Route, msg.Destination, msg.Attempts, msg.LastError, msg.Permanent, history,
+	)
 	return err
 }
 
-func (db *DB) GetPendingMessages() ([]string, error) {
-	rows, err := db.conn.Query("SELECT message FROM failed_messages")
+// marshalHistory encodes an attempt history as a JSON array, never null.
+func marshalHistory(history []Attempt) ([]byte, error) {
+	if history == nil {
+		history = []Attempt{}
+	}
+	return json.Marshal(history)
+}
+
+// failedMessageColumns lists the columns read by scanFailedMessage. Rows
+// written before the Kafka metadata, route and history were stored have
+// NULLs there.
+const failedMessageColumns = `id, message, msg_key, headers, COALESCE(topic, ''), COALESCE(kafka_partition, -1), COALESCE(kafka_offset, -1),
+	COALESCE(route, ''), COALESCE(destination, ''), attempts, COALESCE(last_error, ''), permanent, history, created_at, updated_at`
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFailedMessage reads a row selected with failedMessageColumns.
+func scanFailedMessage(row scanner) (FailedMessage, error) {
+	var msg FailedMessage
+	var value string
+	var headers, history []byte
+	err := row.Scan(&msg.ID, &value, &msg.Message.Key, &headers, &msg.Message.Topic, &msg.Message.Partition, &msg.Message.Offset,
+		&msg.Route, &msg.Destination, &msg.Attempts, &msg.LastError, &msg.Permanent, &history, &msg.CreatedAt, &msg.UpdatedAt)
+	if err != nil {
+		return FailedMessage{}, err
+	}
+	msg.Message.Value = []byte(value)
+	if headers != nil {
+		if err := json.Unmarshal(headers, &msg.Message.Headers); err != nil {
+			return FailedMessage{}, err
+		}
+	}
+	if history != nil {
+		if err := json.Unmarshal(history, &msg.History); err != nil {
+			return FailedMessage{}, err
+		}
+	}
+	return msg, nil
+}
+
+// ClaimPendingMessages claims up to limit replayable failed messages that
+// nobody else holds, oldest first, for the duration of lease. Each claim
+// ends with RecordFailedAttempt, DeleteFailedMessage or
+// ReleaseFailedMessage, or when the lease expires.
+func (db *DB) ClaimPendingMessages(limit int, lease time.Duration) ([]FailedMessage, error) {
+	rows, err := db.conn.Query(
+		`UPDATE failed_messages SET locked_until = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+		 WHERE id IN (
+		     SELECT id FROM failed_messages
+		     WHERE NOT permanent AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+		     ORDER BY id LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING `+failedMessageColumns,
+		limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanFailedMessages(rows)
 	if err != nil {
 		return nil, err
 	}
+	// RETURNING does not keep the order of the subquery
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// scanFailedMessages reads and closes rows selected with failedMessageColumns.
+func scanFailedMessages(rows *sql.Rows) ([]FailedMessage, error) {
 	defer rows.Close()
 
-	var messages []string
+	var messages []FailedMessage
 	for rows.Next() {
-		var msg string
-		if err := rows.Scan(&msg); err != nil {
+		msg, err := scanFailedMessage(rows)
+		if err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
 	}
-	return messages, nil
+	return messages, rows.Err()
+}
+
+// ReleaseFailedMessage ends the claim on a message without changing it.
+func (db *DB) ReleaseFailedMessage(id int64) error {
+	_, err := db.conn.Exec("UPDATE failed_messages SET locked_until = NULL WHERE id = $1", id)
+	return err
+}
+
+// CountPendingMessages returns the number of replayable failed messages.
+func (db *DB) CountPendingMessages() (int, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM failed_messages WHERE NOT permanent").Scan(&count)
+	return count, err
+}
+
+// RecordFailedAttempt bumps the attempt count of a persisted message after an
+// unsuccessful replay, appends attempt to its history and ends the claim on
+// the message. A permanent failure stops further replays.
+func (db *DB) RecordFailedAttempt(id int64, attempt Attempt, permanent bool) error {
+	entry, err := marshalHistory([]Attempt{attempt})
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(
+		`UPDATE failed_messages SET attempts = attempts + 1, last_error = $2, permanent = $3,
+		        history = COALESCE(history, '[]'::jsonb) || $4::jsonb, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $1`,
+		id, attempt.Error, permanent, entry,
+	)
+	return err
+}
+
+// DeleteFailedMessage removes a persisted message, e.g. once it has been
+// delivered, and reports whether it existed.
+func (db *DB) DeleteFailedMessage(id int64) (bool, error) {
+	result, err := db.conn.Exec("DELETE FROM failed_messages WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
 }
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// pruneBatchSize bounds the rows deleted per statement by the retention
+// job, so that pruning a large backlog does not hold locks for long.
+const pruneBatchSize = 10000
+
+// DeliveryAttempt is one delivery attempt of a message to a destination,
+// successful or not.
+type DeliveryAttempt struct {
+	ID          int64     `json:"id"`
+	MessageID   string    `json:"message_id"` // Idempotency-Key of the message
+	Topic       string    `json:"topic"`
+	Partition   int       `json:"partition"`
+	Offset      int64     `json:"offset"`
+	Route       string    `json:"route"`
+	Destination string    `json:"destination"`
+	URL         string    `json:"url"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code,omitempty"`      // Zero if no response was received
+	Response    string    `json:"response_excerpt,omitempty"` // Beginning of the response body of a failed attempt
+	LatencyMS   int64     `json:"latency_ms"`
+	Error       string    `json:"error,omitempty"`
+	At          time.Time `json:"attempted_at"`
+}
+
+// RecordDeliveryAttempt appends an attempt to delivery_attempts. ID and At
+// of attempt are ignored.
+func (db *DB) RecordDeliveryAttempt(attempt DeliveryAttempt) error {
+	_, err := db.conn.Exec(
+		`INSERT INTO delivery_attempts (message_id, topic, kafka_partition, kafka_offset, route, destination, target_url,
+		                                attempt, status_code, response_excerpt, latency_ms, error, attempted_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, 0), NULLIF($10, ''), $11, NULLIF($12, ''), CURRENT_TIMESTAMP)`,
+		attempt.MessageID, attempt.Topic, attempt.Partition, attempt.Offset, attempt.Route, attempt.Destination, attempt.URL,
+		attempt.Attempt, attempt.StatusCode, attempt.Response, attempt.LatencyMS, attempt.Error,
+	)
+	return err
+}
+
+// ListDeliveryAttempts returns every recorded attempt of the message with
+// the given id, to all destinations, oldest first.
+func (db *DB) ListDeliveryAttempts(messageID string) ([]DeliveryAttempt, error) {
+	rows, err := db.conn.Query(
+		`SELECT id, message_id, topic, kafka_partition, kafka_offset, route, destination, target_url,
+		        attempt, status_code, response_excerpt, latency_ms, error, attempted_at
+		 FROM delivery_attempts WHERE message_id = $1 ORDER BY attempted_at, id`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []DeliveryAttempt{}
+	for rows.Next() {
+		var a DeliveryAttempt
+		var topic, response, errText sql.NullString
+		var partition, offset, statusCode sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.MessageID, &topic, &partition, &offset, &a.Route, &a.Destination, &a.URL,
+			&a.Attempt, &statusCode, &response, &a.LatencyMS, &errText, &a.At); err != nil {
+			return nil, err
+		}
+		a.Topic = topic.String
+		a.Partition = int(partition.Int64)
+		a.Offset = offset.Int64
+		a.StatusCode = int(statusCode.Int64)
+		a.Response = response.String
+		a.Error = errText.String
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// CompactDeliveryAttempts deletes the attempts made before cutoff that
+// delivered their message on the first try. Those make up most rows and
+// hold nothing an incident review needs. It returns the number of deleted
+// rows.
+func (db *DB) CompactDeliveryAttempts(cutoff time.Time) (int64, error) {
+	return db.pruneDeliveryAttempts("attempted_at < $1 AND attempt = 1 AND error IS NULL", cutoff)
+}
+
+// DeleteDeliveryAttempts deletes every attempt made before cutoff and
+// returns the number of deleted rows.
+func (db *DB) DeleteDeliveryAttempts(cutoff time.Time) (int64, error) {
+	return db.pruneDeliveryAttempts("attempted_at < $1", cutoff)
+}
+
+// pruneDeliveryAttempts deletes the attempts matching cond, in which $1 is
+// cutoff, in batches of pruneBatchSize.
+func (db *DB) pruneDeliveryAttempts(cond string, cutoff time.Time) (int64, error) {
+	var total int64
+	for {
+		result, err := db.conn.Exec(
+			"DELETE FROM delivery_attempts WHERE id IN (SELECT id FROM delivery_attempts WHERE "+cond+" LIMIT $2)",
+			cutoff, pruneBatchSize,
+		)
+		if err != nil {
+			return total, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
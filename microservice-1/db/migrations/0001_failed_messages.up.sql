@@ -0,0 +1,26 @@
+-- Messages that exhausted their delivery attempts. Databases created before
+-- migrations were introduced already have the table, possibly without some
+-- of the later columns, so every step is idempotent.
+CREATE TABLE IF NOT EXISTS failed_messages (
+    id SERIAL PRIMARY KEY,
+    message TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Permanently failed messages (e.g. rejected with a 4xx) are kept for
+-- inspection but never replayed.
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS permanent BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Kafka metadata of the original record, used for replays and auditing.
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS topic TEXT;
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS kafka_partition INTEGER;
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS kafka_offset BIGINT;
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS msg_key BYTEA;
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS headers JSONB;
+
+-- Route and destination the message failed on, see ROUTES_FILE.
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS route TEXT;
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS destination TEXT;
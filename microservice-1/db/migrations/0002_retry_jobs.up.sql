@@ -0,0 +1,20 @@
+-- Messages waiting for their next delivery attempt when RETRY_SCHEDULER is
+-- postgres. Workers of all replicas claim due jobs with FOR UPDATE SKIP LOCKED.
+CREATE TABLE IF NOT EXISTS retry_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    message TEXT NOT NULL,
+    msg_key BYTEA,
+    headers JSONB,
+    topic TEXT,
+    kafka_partition INTEGER,
+    kafka_offset BIGINT,
+    route TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    delay_ms BIGINT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS retry_jobs_next_attempt_at ON retry_jobs (next_attempt_at);
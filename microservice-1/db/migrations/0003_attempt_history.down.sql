@@ -0,0 +1,2 @@
+ALTER TABLE failed_messages DROP COLUMN IF EXISTS history;
+ALTER TABLE retry_jobs DROP COLUMN IF EXISTS history;
@@ -0,0 +1,4 @@
+-- Failed attempts of a message, oldest first, as a JSON array of
+-- {"number", "at", "status_code", "error"}.
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS history JSONB;
+ALTER TABLE retry_jobs ADD COLUMN IF NOT EXISTS history JSONB;
@@ -0,0 +1,21 @@
+-- Every delivery attempt made by the retry handler, for incident review.
+-- message_id is the Idempotency-Key of the message. Old rows are compacted
+-- and deleted by the retention job, see DELIVERY_ATTEMPTS_RETENTION.
+CREATE TABLE IF NOT EXISTS delivery_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    topic TEXT,
+    kafka_partition INTEGER,
+    kafka_offset BIGINT,
+    route TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    target_url TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER,
+    response_excerpt TEXT,
+    latency_ms INTEGER NOT NULL,
+    error TEXT,
+    attempted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS delivery_attempts_message_id ON delivery_attempts (message_id, attempted_at);
+CREATE INDEX IF NOT EXISTS delivery_attempts_attempted_at ON delivery_attempts (attempted_at);
@@ -0,0 +1 @@
+ALTER TABLE failed_messages DROP COLUMN IF EXISTS locked_until;
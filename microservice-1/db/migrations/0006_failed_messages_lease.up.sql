@@ -0,0 +1,4 @@
+-- A replayer claims failed messages by setting locked_until, so that
+-- replicas and the admin API never replay the same message at once. An
+-- expired lease means its holder died and the message may be claimed again.
+ALTER TABLE failed_messages ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
@@ -0,0 +1 @@
+ALTER TABLE retry_jobs DROP COLUMN IF EXISTS locked_until;
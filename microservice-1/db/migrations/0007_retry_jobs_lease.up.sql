@@ -0,0 +1,5 @@
+-- A scheduler worker claims a due retry job by setting locked_until for the
+-- duration of its delivery attempt instead of holding a row lock, so no
+-- transaction stays open while Microservice-2 answers. An expired lease means
+-- its holder died and the job may be claimed again.
+ALTER TABLE retry_jobs ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
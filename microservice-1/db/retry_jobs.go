@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"microservice-1/queue"
+)
+
+// RetryJob is a message waiting in retry_jobs for its next delivery attempt
+// to one destination.
+type RetryJob struct {
+	ID          int64
+	Message     queue.Message
+	Route       string
+	Destination string
+	Attempts    int           // Attempts made so far
+	LastError   string        // Error of the last attempt
+	Delay       time.Duration // Backoff delay before the next attempt
+	History     []Attempt     // Failed attempts, oldest first
+	CreatedAt   time.Time     // Roughly the time of the first attempt
+}
+
+// EnqueueRetryJob stores a job due after job.Delay. ID and CreatedAt of job
+// are ignored.
+func (db *DB) EnqueueRetryJob(job RetryJob) error {
+	headers, err := json.Marshal(job.Message.Headers)
+	if err != nil {
+		return err
+	}
+	history, err := marshalHistory(job.History)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(
+		`INSERT INTO retry_jobs (message, msg_key, headers, topic, kafka_partition, kafka_offset, route, destination,
+		                         attempts, last_error, delay_ms, history, next_attempt_at, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12,
+		         CURRENT_TIMESTAMP + $11 * INTERVAL '1 millisecond', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		string(job.Message.Value), job.Message.Key, headers, job.Message.Topic, job.Message.Partition, job.Message.Offset,
+		job.Route, job.Destination, job.Attempts, job.LastError, job.Delay.Milliseconds(), history,
+	)
+	return err
+}
+
+// CountRetryJobs returns the number of scheduled retries.
+func (db *DB) CountRetryJobs() (int, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM retry_jobs").Scan(&count)
+	return count, err
+}
+
+// ClaimedRetryJob is a due job claimed by ClaimRetryJob. Exactly one of
+// Reschedule, Complete, Fail or Release must be called to end the claim.
+// They do not take a context: the outcome of an attempt that was made must
+// be recorded even when the worker is shutting down.
+type ClaimedRetryJob struct {
+	RetryJob
+	db *DB
+}
+
+// ClaimRetryJob claims the job that has been due the longest for the
+// duration of lease and returns it, or nil if no job is due. Jobs claimed by
+// other workers, including those of other replicas, are skipped. The claim
+// is a short statement that sets locked_until, so no transaction or
+// connection is held during the delivery attempt, and the job of a crashed
+// worker becomes available again once its lease expires.
+func (db *DB) ClaimRetryJob(ctx context.Context, lease time.Duration) (*ClaimedRetryJob, error) {
+	job := &ClaimedRetryJob{db: db}
+	var value string
+	var headers, history []byte
+	var delayMs int64
+	err := db.conn.QueryRowContext(ctx,
+		`UPDATE retry_jobs SET locked_until = CURRENT_TIMESTAMP + $1 * INTERVAL '1 millisecond'
+		 WHERE id = (
+		     SELECT id FROM retry_jobs
+		     WHERE next_attempt_at <= CURRENT_TIMESTAMP AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+		     ORDER BY next_attempt_at
+		     LIMIT 1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, message, msg_key, headers, COALESCE(topic, ''), COALESCE(kafka_partition, -1), COALESCE(kafka_offset, -1),
+		           route, destination, attempts, COALESCE(last_error, ''), delay_ms, history, created_at`,
+		lease.Milliseconds(),
+	).Scan(&job.ID, &value, &job.Message.Key, &headers, &job.Message.Topic, &job.Message.Partition, &job.Message.Offset,
+		&job.Route, &job.Destination, &job.Attempts, &job.LastError, &delayMs, &history, &job.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.Message.Value = []byte(value)
+	job.Delay = time.Duration(delayMs) * time.Millisecond
+	if headers != nil {
+		if err := json.Unmarshal(headers, &job.Message.Headers); err != nil {
+			return nil, job.decodeFailed(err)
+		}
+	}
+	if history != nil {
+		if err := json.Unmarshal(history, &job.History); err != nil {
+			return nil, job.decodeFailed(err)
+		}
+	}
+	return job, nil
+}
+
+// decodeFailed releases a job whose row could not be decoded and returns err.
+func (j *ClaimedRetryJob) decodeFailed(err error) error {
+	j.Release()
+	return err
+}
+
+// Reschedule makes the job due again after delay and ends the claim. A
+// non-nil attempt is the failed attempt just made and is added to the
+// history; without one the job is postponed without counting an attempt.
+func (j *ClaimedRetryJob) Reschedule(delay time.Duration, attempt *Attempt) error {
+	if attempt == nil {
+		_, err := j.db.conn.Exec(
+			`UPDATE retry_jobs SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond', locked_until = NULL,
+			        updated_at = CURRENT_TIMESTAMP
+			 WHERE id = $1`,
+			j.ID, delay.Milliseconds(),
+		)
+		return err
+	}
+
+	entry, err := marshalHistory([]Attempt{*attempt})
+	if err != nil {
+		j.Release()
+		return err
+	}
+	_, err = j.db.conn.Exec(
+		`UPDATE retry_jobs SET attempts = $2, last_error = $3, delay_ms = $4, history = COALESCE(history, '[]'::jsonb) || $5::jsonb,
+		        next_attempt_at = CURRENT_TIMESTAMP + $4 * INTERVAL '1 millisecond', locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $1`,
+		j.ID, attempt.Number, attempt.Error, delay.Milliseconds(), entry,
+	)
+	return err
+}
+
+// Complete removes the job after a successful delivery.
+func (j *ClaimedRetryJob) Complete() error {
+	_, err := j.db.conn.Exec("DELETE FROM retry_jobs WHERE id = $1", j.ID)
+	return err
+}
+
+// Fail moves the job to failed_messages in one transaction. Message, Route
+// and Destination of failed are taken from the job; its History should be
+// the history of the job plus the last attempt.
+func (j *ClaimedRetryJob) Fail(failed FailedMessage) error {
+	failed.Message = j.Message
+	failed.Route = j.Route
+	failed.Destination = j.Destination
+	tx, err := j.db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := saveFailedMessage(tx, failed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM retry_jobs WHERE id = $1", j.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Release gives the job up unchanged, e.g. on shutdown.
+func (j *ClaimedRetryJob) Release() error {
+	_, err := j.db.conn.Exec("UPDATE retry_jobs SET locked_until = NULL WHERE id = $1", j.ID)
+	return err
+}
@@ -0,0 +1,216 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"microservice-1/config"
+)
+
+// New returns the HTTP client used for deliveries. Requests have no overall
+// timeout here; callers bound them through their context. If a CA bundle or
+// client certificate is configured, the files are checked for changes at
+// most every TLSReloadInterval during handshakes and reloaded when they
+// changed, so rotated certificates are picked up without a restart. With a
+// signing secret every request is signed, see signingTransport.
+func New(config config.HTTPClientConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: config.TLSHandshakeTimeout,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" || config.TLSCAFile != "" || config.TLSServerName != "" {
+		files := &tlsFiles{
+			caFile:   config.TLSCAFile,
+			certFile: config.TLSCertFile,
+			keyFile:  config.TLSKeyFile,
+			interval: config.TLSReloadInterval,
+			// Connections made with the old files stay open until idle
+			changed: transport.CloseIdleConnections,
+		}
+		if err := files.load(); err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = files.tlsConfig(config.TLSServerName)
+	}
+
+	if config.SigningSecret != "" {
+		return &http.Client{Transport: &signingTransport{
+			keyID:  config.SigningKeyID,
+			secret: []byte(config.SigningSecret),
+			next:   transport,
+		}}, nil
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// tlsFiles holds the CA bundle and client certificate read from disk and
+// reloads them when their modification times change.
+type tlsFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	interval time.Duration
+	changed  func() // Called after the files were reloaded
+
+	mu        sync.Mutex
+	roots     *x509.CertPool   // nil without a CA file
+	cert      *tls.Certificate // nil without a client certificate
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// tlsConfig returns a TLS configuration that always uses the current files.
+func (f *tlsFiles) tlsConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if f.certFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			f.reloadIfChanged()
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return f.cert, nil
+		}
+	}
+	if f.caFile != "" {
+		// The roots can change at runtime, which tls.Config.RootCAs does not
+		// allow for, so the chain is verified here instead.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			f.reloadIfChanged()
+			f.mu.Lock()
+			roots := f.roots
+			f.mu.Unlock()
+			return verifyChain(cs, roots)
+		}
+	}
+	return cfg
+}
+
+// verifyChain does the verification skipped through InsecureSkipVerify:
+// the peer chain must lead to roots and be valid for the server name.
+func verifyChain(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// reloadIfChanged reloads the files if interval has passed since the last
+// check and any of them was modified. A failed reload is logged and the
+// previous files stay in use.
+func (f *tlsFiles) reloadIfChanged() {
+	f.mu.Lock()
+	if f.interval <= 0 || time.Since(f.lastCheck) < f.interval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastCheck = time.Now()
+	modTimes := f.modTimes
+	f.mu.Unlock()
+
+	changed := false
+	for path, modTime := range modTimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to check TLS file %s: %v\n", path, err)
+			return
+		}
+		if !info.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := f.load(); err != nil {
+		log.Printf("Failed to reload TLS files, keeping the previous ones: %v\n", err)
+		return
+	}
+	log.Println("Reloaded TLS files of the HTTP client")
+	if f.changed != nil {
+		f.changed()
+	}
+}
+
+// load reads all configured files.
+func (f *tlsFiles) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{f.caFile, f.certFile, f.keyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	var roots *x509.CertPool
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+	}
+
+	var cert *tls.Certificate
+	if f.certFile != "" || f.keyFile != "" {
+		pair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+		cert = &pair
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roots = roots
+	f.cert = cert
+	f.modTimes = modTimes
+	f.lastCheck = time.Now()
+	return nil
+}
@@ -0,0 +1,62 @@
+package httpclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// roundTripFunc captures the requests passed on by signingTransport.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestSigningTransport(t *testing.T) {
+	tests := []struct {
+		method, url, body string
+		wantURI           string
+	}{
+		{"POST", "http://microservice-2:8081/api/data", `{"data":"a"}`, "/api/data"},
+		{"POST", "http://microservice-2:8081/api/data/bulk?dry_run=1", `[]`, "/api/data/bulk?dry_run=1"},
+		{"GET", "http://microservice-2:8081/", "", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			var sent *http.Request
+			var sentBody []byte
+			transport := &signingTransport{keyID: "k1", secret: []byte("s1"), next: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				sent = r
+				sentBody, _ = io.ReadAll(r.Body)
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})}
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := transport.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+
+			if string(sentBody) != tt.body {
+				t.Fatalf("body = %q, want %q", sentBody, tt.body)
+			}
+			if sent.Header.Get(HeaderSignatureKeyID) != "k1" || sent.Header.Get(HeaderSignatureNonce) == "" {
+				t.Fatalf("missing signature headers: %v", sent.Header)
+			}
+			mac := hmac.New(sha256.New, []byte("s1"))
+			mac.Write([]byte(sent.Header.Get(HeaderSignatureTimestamp) + "\n" + sent.Header.Get(HeaderSignatureNonce) + "\n" + tt.method + "\n" + tt.wantURI + "\n" + tt.body))
+			if got, want := sent.Header.Get(HeaderSignature), hex.EncodeToString(mac.Sum(nil)); got != want {
+				t.Fatalf("signature = %s, want %s", got, want)
+			}
+			if req.Header.Get(HeaderSignature) != "" {
+				t.Fatal("the original request was modified")
+			}
+		})
+	}
+}
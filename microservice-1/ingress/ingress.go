@@ -0,0 +1,144 @@
+package ingress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"microservice-1/queue"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// maxBodySize limits the size of a POST /api/send request body.
+const maxBodySize = 10 << 20
+
+// publishTimeout bounds waiting for the broker to acknowledge a request.
+const publishTimeout = 30 * time.Second
+
+// SendRequest is one message to publish. Value is published as is, except
+// that a JSON string is published without its quotes.
+type SendRequest struct {
+	Key     string            `json:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Value   json.RawMessage   `json:"value"`
+}
+
+// SendResponse reports where a message was published.
+type SendResponse struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"` // -1 when the producer does not wait for acks
+}
+
+// Handler implements POST /api/send, publishing JSON payloads to the queue
+// so that upstream systems do not need a Kafka client.
+type Handler struct {
+	publisher queue.Publisher
+}
+
+// NewHandler returns a handler publishing through publisher.
+func NewHandler(publisher queue.Publisher) *Handler {
+	return &Handler{publisher: publisher}
+}
+
+// ServeHTTP accepts either a single SendRequest object, answered with a
+// SendResponse, or an array of them, published as one batch and answered
+// with an array of SendResponses in the same order. Both answer 202 once the
+// broker acknowledged the messages.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxBodySize)
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		log.Printf("Error decoding send request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	batch := len(bytes.TrimSpace(raw)) > 0 && bytes.TrimSpace(raw)[0] == '['
+	var requests []SendRequest
+	if batch {
+		if err := json.Unmarshal(raw, &requests); err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+	} else {
+		var request SendRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+		requests = []SendRequest{request}
+	}
+	if len(requests) == 0 {
+		http.Error(w, "No messages", http.StatusBadRequest)
+		return
+	}
+
+	msgs := make([]queue.Message, len(requests))
+	for i, request := range requests {
+		msg, err := request.message()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msgs[i] = msg
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), publishTimeout)
+	defer cancel()
+	published, err := h.publisher.Publish(ctx, msgs...)
+	if err != nil {
+		log.Printf("Error publishing %d messages: %v", len(msgs), err)
+		http.Error(w, "Failed to publish message", http.StatusServiceUnavailable)
+		return
+	}
+
+	responses := make([]SendResponse, len(published))
+	for i, msg := range published {
+		responses[i] = SendResponse{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if batch {
+		json.NewEncoder(w).Encode(responses)
+	} else {
+		json.NewEncoder(w).Encode(responses[0])
+	}
+}
+
+// message converts the request into a queue message.
+func (req SendRequest) message() (queue.Message, error) {
+	if len(req.Value) == 0 || string(req.Value) == "null" {
+		return queue.Message{}, errors.New("value is required")
+	}
+
+	var msg queue.Message
+	var text string
+	if err := json.Unmarshal(req.Value, &text); err == nil {
+		msg.Value = []byte(text)
+	} else {
+		msg.Value = []byte(req.Value)
+	}
+	if req.Key != "" {
+		msg.Key = []byte(req.Key)
+	}
+
+	// Sort header names so the record does not depend on map order
+	names := make([]string, 0, len(req.Headers))
+	for name := range req.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg.Headers = append(msg.Headers, queue.Header{Key: name, Value: []byte(req.Headers[name])})
+	}
+	return msg, nil
+}
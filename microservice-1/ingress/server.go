@@ -0,0 +1,54 @@
+package ingress
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"microservice-1/queue"
+	"net/http"
+	"strings"
+)
+
+// Server serves POST /api/send on its own port, apart from the admin
+// server, so that upstream systems can be given access to it alone.
+type Server struct {
+	token  string
+	server *http.Server
+}
+
+// NewServer returns a server listening on port that publishes through
+// publisher and only accepts requests carrying token as bearer token.
+func NewServer(port, token string, publisher queue.Publisher) *Server {
+	s := &Server{token: token}
+	mux := http.NewServeMux()
+	mux.Handle("/api/send", s.authenticate(NewHandler(publisher)))
+	s.server = &http.Server{Addr: ":" + port, Handler: mux}
+	return s
+}
+
+// Start runs the HTTP server until Shutdown is called.
+func (s *Server) Start() {
+	log.Printf("Starting ingress server on %s...", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops the HTTP server, waiting for active requests until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// authenticate rejects requests without an "Authorization: Bearer <token>"
+// header matching the configured token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ingress"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
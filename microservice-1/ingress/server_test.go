@@ -0,0 +1,48 @@
+package ingress
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"microservice-1/queue"
+)
+
+// fakePublisher accepts every message at offset 0.
+type fakePublisher struct{}
+
+func (fakePublisher) Publish(ctx context.Context, msgs ...queue.Message) ([]queue.Message, error) {
+	return msgs, nil
+}
+
+func (fakePublisher) Close() error { return nil }
+
+func TestServerRequiresToken(t *testing.T) {
+	s := NewServer("0", "secret", fakePublisher{})
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"valid token", "Bearer secret", http.StatusAccepted},
+		{"wrong token", "Bearer other", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"basic auth", "Basic c2VjcmV0Og==", http.StatusUnauthorized},
+		{"no header", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{"value": {"a": 1}}`))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.server.Handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
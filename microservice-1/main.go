@@ -1,27 +1,334 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"microservice-1/admin"
+	"microservice-1/breaker"
 	"microservice-1/config"
+	"microservice-1/db"
+	"microservice-1/httpclient"
+	"microservice-1/ingress"
+	"microservice-1/metrics"
 	"microservice-1/queue"
 	"microservice-1/retry"
+	"microservice-1/tracing"
+	"microservice-1/worker"
+	"os"
+	"os/signal"
+	"shared/migrate"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
-	// Initialize configurations
-	cfg := config.LoadConfig()
+	// Load the configuration from defaults, the config file, the environment
+	// and the command line flags
+	loader, err := config.NewLoader(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", cfg.Redacted())
+
+	// Stop consuming on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Initialize the database and bring its schema up to date, or only run
+	// the migrate subcommand
+	database := db.NewDB(cfg.DatabaseURL)
+	defer database.Close()
+	migrator, err := database.Migrator()
+	if err != nil {
+		log.Fatalf("Invalid migrations: %v", err)
+	}
+	if args := loader.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := migrate.Run(ctx, migrator, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cfg.MigrateOnStart {
+		if err := migrator.Up(ctx); err != nil {
+			log.Fatalf("Failed to migrate the database: %v", err)
+		}
+	}
+
+	// Export traces of consumed messages and their deliveries
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingConfig, "microservice-1")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
 
 	// Start consuming messages from the queue
 	log.Println("Starting Microservice-1...")
-	consumer := queue.NewConsumer(cfg.QueueConfig)
-	retryHandler := retry.NewRetryHandler(cfg.RetryConfig)
-
-	for message := range consumer.Messages() {
-		go func(msg string) {
-			err := retryHandler.ProcessMessage(msg)
-			if err != nil {
-				log.Printf("Failed to process message: %s, Error: %v\n", msg, err)
-			}
-		}(message)
+	consumer, err := queue.NewConsumer(cfg.QueueConfig)
+	if err != nil {
+		log.Fatalf("Invalid queue configuration: %v", err)
+	}
+
+	// Deliver over a client with timeouts, connection limits and TLS settings
+	client, err := httpclient.New(cfg.RetryConfig.HTTP)
+	if err != nil {
+		log.Fatalf("Invalid HTTP client configuration: %v", err)
+	}
+
+	// Load the routing table and keep it up to date
+	router, err := retry.NewRouter(cfg.RetryConfig, cfg.BreakerConfig, client)
+	if err != nil {
+		log.Fatalf("Invalid retry configuration: %v", err)
+	}
+
+	// Pause consumption while the circuit to any required destination is
+	// open. The first message fetched after the probe interval acts as the
+	// probe.
+	router.OnBreakerStateChange(func(destination string, from, to breaker.State) {
+		if to == breaker.Open {
+			consumer.Pause("circuit-open:" + destination)
+		} else {
+			consumer.Resume("circuit-open:" + destination)
+		}
+	})
+
+	// Publish permanently failed messages to the dead-letter topic, if configured
+	dlq := queue.NewDeadLetterProducer(cfg.QueueConfig)
+
+	retryHandler, err := retry.NewRetryHandler(cfg.RetryConfig, router, database, dlq)
+	if err != nil {
+		log.Fatalf("Invalid retry configuration: %v", err)
+	}
+
+	// Replay persisted messages, deliver scheduled retries, prune the
+	// delivery attempt log and reload routes and the configuration in the
+	// background
+	var background sync.WaitGroup
+	replayer := retry.NewReplayer(cfg.RetryConfig, retryHandler, database)
+	scheduler := retry.NewScheduler(cfg.RetryConfig, retryHandler, database)
+	retention := retry.NewRetention(cfg.RetryConfig, database)
+	background.Add(6)
+	go func() {
+		defer background.Done()
+		replayer.Run(ctx)
+	}()
+	go func() {
+		defer background.Done()
+		scheduler.Run(ctx)
+	}()
+	go func() {
+		defer background.Done()
+		retention.Run(ctx)
+	}()
+	go func() {
+		defer background.Done()
+		router.Watch(ctx)
+	}()
+	go func() {
+		defer background.Done()
+		reloadOnHangup(ctx, loader, cfg, router)
+	}()
+
+	// Pause consumption while deliveries pile up behind a slow or
+	// unavailable Microservice-2. The derived in-flight watermarks depend on
+	// whether a route batches, so they are recomputed as routes are reloaded.
+	inFlightWatermarks := func() (high, low int64) {
+		h, l := cfg.InFlightWatermarks(router.Batching())
+		return int64(h), int64(l)
+	}
+	if inFlightHigh, inFlightLow := inFlightWatermarks(); inFlightHigh > 0 {
+		log.Printf("Pausing consumption at %d deliveries in flight, resuming at %d\n", inFlightHigh, inFlightLow)
+	}
+	go func() {
+		defer background.Done()
+		b := cfg.Backpressure
+		consumer.WatchBackpressure(ctx, b.CheckInterval,
+			queue.Watermark{
+				Name:   "in-flight",
+				Value:  func() (int64, error) { return retryHandler.InFlight(), nil },
+				Levels: inFlightWatermarks,
+			},
+			queue.Watermark{
+				Name:  "retry-backlog",
+				Value: retryHandler.Backlog,
+				High:  int64(b.BacklogHigh),
+				Low:   int64(b.BacklogLow),
+			},
+		)
+	}()
+
+	// Accept messages over HTTP and publish them to the queue
+	publisher, err := queue.NewPublisher(cfg.QueueConfig, consumer.Source())
+	if err != nil {
+		log.Fatalf("Invalid producer configuration: %v", err)
+	}
+
+	// Serve health probes, status and metrics on the admin port
+	if len(cfg.AdminTokens) == 0 {
+		log.Println("ADMIN_TOKENS is not set, only health probes, status and metrics are served on the admin port")
+	}
+	adminServer := admin.NewServer(cfg.AdminPort, cfg.AdminTokens, cfg.RetryConfig.ReplayLease, consumer, database, retryHandler, router)
+	metrics.RegisterConsumer(consumer)
+	metrics.RegisterBreakers(router)
+	adminServer.Handle("/metrics", metrics.Handler())
+	go adminServer.Start()
+
+	// Serve the ingress on its own port, if a token to authenticate it is set
+	var ingressServer *ingress.Server
+	if cfg.IngressToken != "" {
+		ingressServer = ingress.NewServer(cfg.IngressPort, cfg.IngressToken, publisher)
+		go ingressServer.Start()
+	} else {
+		log.Println("INGRESS_TOKEN is not set, not serving POST /api/send")
+	}
+
+	// Deliveries get their own context so that they can outlive ctx by up to
+	// cfg.ShutdownTimeout. Cancelling it makes them persist their message.
+	deliveryCtx, cancelDeliveries := context.WithCancel(context.Background())
+	defer cancelDeliveries()
+
+	// Deliver messages on a bounded pool; messages sharing a key stay in order.
+	// Messages awaiting a batch result are committed in the background.
+	pool := worker.NewPool(cfg.WorkerConfig)
+	var acks sync.WaitGroup
+
+	for message := range consumer.Messages(ctx) {
+		msg := message
+		pool.Submit(msg.LaneKey(), func() {
+			handleMessage(deliveryCtx, consumer, retryHandler, msg, cfg.RetryConfig.RetryDelay, &acks)
+		})
+	}
+
+	// The message channel only closes once ctx is done
+	log.Println("Shutting down, waiting for in-flight deliveries...")
+	drained := make(chan struct{})
+	go func() {
+		pool.Close()
+		acks.Wait()
+		retryHandler.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Printf("Deliveries still in flight after %v, persisting them\n", cfg.ShutdownTimeout)
+		cancelDeliveries()
+		<-drained
+	}
+	background.Wait()
+
+	if err := consumer.Close(); err != nil {
+		log.Printf("Failed to close consumer: %v\n", err)
+	}
+	if dlq != nil {
+		if err := dlq.Close(); err != nil {
+			log.Printf("Failed to close dead-letter producer: %v\n", err)
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := adminServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to stop admin server: %v\n", err)
+	}
+	if ingressServer != nil {
+		if err := ingressServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to stop ingress server: %v\n", err)
+		}
+	}
+	if err := publisher.Close(); err != nil {
+		log.Printf("Failed to close producer: %v\n", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Failed to flush traces: %v\n", err)
+	}
+	log.Println("Microservice-1 stopped")
+}
+
+// reloadOnHangup loads the configuration again on every SIGHUP until ctx is
+// done and applies the settings that can change at runtime, i.e. those of
+// the default route and the routes file, which is re-read as well. Changes
+// to other settings are logged and take effect on the next restart; running
+// is the configuration in effect, which later reloads are compared to.
+func reloadOnHangup(ctx context.Context, loader *config.Loader, running config.Config, router *retry.Router) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		cfg, err := loader.Load()
+		if err != nil {
+			log.Printf("Failed to reload configuration, keeping the current one: %v\n", err)
+			continue
+		}
+		reloadable, restart := config.Changes(running, cfg)
+		if len(restart) > 0 {
+			log.Printf("Changes to %s take effect after a restart\n", strings.Join(restart, ", "))
+		}
+		applied := config.Apply(running, cfg)
+		if err := router.Reconfigure(applied.RetryConfig); err != nil {
+			log.Printf("Failed to apply reloaded configuration, keeping the current one: %v\n", err)
+			continue
+		}
+		running = applied
+		if len(reloadable) > 0 {
+			log.Printf("Reloaded configuration, applied changes to %s\n", strings.Join(reloadable, ", "))
+		} else {
+			log.Println("Reloaded configuration and routes")
+		}
+	}
+}
+
+// handleMessage processes msg and commits its offset, see finishMessage.
+// A message that waits for the result of a batch is committed in a
+// goroutine tracked by acks once that result is in, so that the worker lane
+// can go on with the next message meanwhile.
+func handleMessage(ctx context.Context, consumer *queue.Consumer, handler *retry.RetryHandler, msg queue.Message, retryDelay time.Duration, acks *sync.WaitGroup) {
+	result := handler.ProcessMessage(ctx, msg)
+	select {
+	case err := <-result:
+		finishMessage(ctx, consumer, handler, msg, retryDelay, err)
+	default:
+		acks.Add(1)
+		go func() {
+			defer acks.Done()
+			finishMessage(ctx, consumer, handler, msg, retryDelay, <-result)
+		}()
+	}
+}
+
+// finishMessage commits the offset of msg, which was processed with the
+// outcome err. A message that could be neither delivered nor persisted nor
+// dead-lettered must not be committed, but left uncommitted it would hold
+// back every later commit on its partition. Consumption is paused instead
+// and the message is processed again every retryDelay until that succeeds.
+// If deliveries are cancelled on shutdown first, the message stays
+// uncommitted and is redelivered after the restart.
+func finishMessage(ctx context.Context, consumer *queue.Consumer, handler *retry.RetryHandler, msg queue.Message, retryDelay time.Duration, err error) {
+	reason := fmt.Sprintf("unhandled:%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+	defer consumer.Resume(reason)
+	for err != nil {
+		log.Printf("Failed to process message at offset %d on partition %d, retrying in %v: %v\n", msg.Offset, msg.Partition, retryDelay, err)
+		consumer.Pause(reason)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+		err = <-handler.ProcessMessage(ctx, msg)
+	}
+	if err := consumer.Ack(msg); err != nil {
+		log.Printf("Failed to commit offset %d on partition %d: %v\n", msg.Offset, msg.Partition, err)
 	}
 }
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"microservice-1/breaker"
+)
+
+const namespace = "relay"
+
+var (
+	// MessagesConsumed counts messages fetched from Kafka.
+	MessagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Messages fetched from Kafka.",
+	})
+
+	// MessagesDelivered counts messages accepted by Microservice-2, including replays.
+	MessagesDelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_delivered_total",
+		Help:      "Messages delivered to Microservice-2, including replays of failed messages.",
+	})
+
+	// MessagesRetried counts delivery attempts that were followed by a retry.
+	MessagesRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_retried_total",
+		Help:      "Failed delivery attempts that were scheduled for a retry.",
+	})
+
+	// MessagesPermanentlyFailed counts messages rejected with a non-retryable error.
+	MessagesPermanentlyFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_permanently_failed_total",
+		Help:      "Messages rejected by Microservice-2 with a non-retryable status.",
+	})
+
+	// MessagesFailedPersisted counts messages persisted to failed_messages.
+	MessagesFailedPersisted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_failed_persisted_total",
+		Help:      "Messages that were not delivered and were persisted to failed_messages.",
+	})
+
+	// MessagesDLQPublished counts permanently failed messages published to the dead-letter topic.
+	MessagesDLQPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dlq_published_total",
+		Help:      "Permanently failed messages published to the Kafka dead-letter topic.",
+	})
+
+	// DeliveryLatency observes the time from the first attempt until a
+	// message was delivered.
+	DeliveryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_latency_seconds",
+		Help:      "Time from the first delivery attempt until Microservice-2 accepted the message.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900},
+	})
+
+	// DeliveryAttempts observes the number of attempts spent per message,
+	// whether or not it was delivered in the end.
+	DeliveryAttempts = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_attempts",
+		Help:      "Delivery attempts spent per message.",
+		Buckets:   []float64{1, 2, 3, 4, 5, 7, 10, 15, 20},
+	})
+
+	// DeliveriesInFlight is the number of messages currently being delivered.
+	DeliveriesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deliveries_in_flight",
+		Help:      "Messages currently being delivered or waiting for a retry.",
+	})
+)
+
+// ConsumerStats is implemented by queue.Consumer.
+type ConsumerStats interface {
+	Lag() int64
+	PartitionLag() map[int]int64
+	PauseReasons() []string
+}
+
+// consumerCollector reports consumer lag at scrape time.
+type consumerCollector struct {
+	consumer     ConsumerStats
+	readerLag    *prometheus.Desc
+	partitionLag *prometheus.Desc
+	paused       *prometheus.Desc
+}
+
+// RegisterConsumer exports the lag and pause reasons of consumer.
+func RegisterConsumer(consumer ConsumerStats) {
+	prometheus.MustRegister(&consumerCollector{
+		consumer: consumer,
+		readerLag: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "consumer", "lag"),
+			"Consumer lag as reported by the queue backend; for Kafka the value of kafka.Reader.Stats().",
+			nil, nil,
+		),
+		partitionLag: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "consumer", "partition_lag"),
+			"Messages behind the high-water mark of each partition, as of the last fetched message.",
+			[]string{"partition"}, nil,
+		),
+		paused: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "consumer", "paused"),
+			"Reasons consumption is currently paused for, e.g. manual or backpressure:in-flight; one series per reason.",
+			[]string{"reason"}, nil,
+		),
+	})
+}
+
+func (c *consumerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.readerLag
+	ch <- c.partitionLag
+	ch <- c.paused
+}
+
+func (c *consumerCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.readerLag, prometheus.GaugeValue, float64(c.consumer.Lag()))
+
+	for partition, lag := range c.consumer.PartitionLag() {
+		ch <- prometheus.MustNewConstMetric(c.partitionLag, prometheus.GaugeValue, float64(lag), strconv.Itoa(partition))
+	}
+	for _, reason := range c.consumer.PauseReasons() {
+		ch <- prometheus.MustNewConstMetric(c.paused, prometheus.GaugeValue, 1, reason)
+	}
+}
+
+// BreakerStats is implemented by retry.Router.
+type BreakerStats interface {
+	BreakerStates() map[string]breaker.State
+}
+
+// breakerCollector reports the circuit breaker states at scrape time.
+type breakerCollector struct {
+	breakers BreakerStats
+	state    *prometheus.Desc
+}
+
+// RegisterBreakers exports the circuit breaker state of every destination
+// of breakers.
+func RegisterBreakers(breakers BreakerStats) {
+	prometheus.MustRegister(&breakerCollector{
+		breakers: breakers,
+		state: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "circuit", "state"),
+			"Circuit breaker state of each destination: 0 closed, 1 open, 2 half-open.",
+			[]string{"destination"}, nil,
+		),
+	})
+}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	for destination, state := range c.breakers.BreakerStates() {
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, float64(state), destination)
+	}
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Watermark pauses consumption while a measure of downstream backpressure is
+// high. Consumption is paused once the value reaches High and resumed once it
+// has dropped to Low or below, so that it does not flap around a single
+// threshold.
+type Watermark struct {
+	Name   string                   // Pause reason is "backpressure:" followed by Name
+	Value  func() (int64, error)    // Current value of the measure
+	High   int64                    // Value at which consumption pauses; zero disables the watermark
+	Low    int64                    // Value at or below which consumption resumes
+	Levels func() (high, low int64) // If set, replaces High and Low on every check, for levels that follow reloads
+}
+
+// WatchBackpressure checks watermarks every interval until ctx is done and
+// pauses or resumes consumption accordingly. A watermark whose value cannot
+// be determined keeps its current state.
+func (c *Consumer) WatchBackpressure(ctx context.Context, interval time.Duration, watermarks ...Watermark) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, watermark := range watermarks {
+			c.checkWatermark(watermark)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Consumer) checkWatermark(watermark Watermark) {
+	high, low := watermark.High, watermark.Low
+	if watermark.Levels != nil {
+		high, low = watermark.Levels()
+	}
+	if high <= 0 {
+		return
+	}
+	value, err := watermark.Value()
+	if err != nil {
+		log.Printf("Failed to check %s backpressure: %v\n", watermark.Name, err)
+		return
+	}
+
+	reason := "backpressure:" + watermark.Name
+	paused := c.Paused(reason)
+	switch {
+	case !paused && value >= high:
+		log.Printf("%s at %d, reached high-water mark %d\n", watermark.Name, value, high)
+		c.Pause(reason)
+	case paused && value <= low:
+		log.Printf("%s at %d, back at low-water mark %d\n", watermark.Name, value, low)
+		c.Resume(reason)
+	}
+}
@@ -3,37 +3,251 @@ package queue
 import (
 	"context"
 	"log"
+	"sort"
+	"sync"
 
 	"microservice-1/config"
-
-	"github.com/segmentio/kafka-go"
+	"microservice-1/metrics"
 )
 
+// Consumer fetches messages from a Source, commits them in order once they
+// have been handled and lets consumption be paused.
 type Consumer struct {
-	reader *kafka.Reader
+	source Source
+
+	mu      sync.Mutex
+	offsets map[topicPartition]*partitionOffsets
+
+	pauseMu sync.Mutex
+	paused  map[string]bool // Reasons consumption is currently paused for
+	resumed chan struct{}   // Closed once no reason is left
 }
 
-func NewConsumer(config config.QueueConfig) *Consumer {
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{config.Broker},
-		Topic:   config.Topic,
-		GroupID: config.GroupID,
-	})
-	return &Consumer{reader: reader}
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// partitionOffsets tracks the messages fetched from one partition that have
+// not been committed yet, in the order they were fetched.
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]bool
+	lag     int64 // Distance to the high-water mark as of the last fetch
+}
+
+// NewConsumer creates a consumer for the backend selected in config.
+func NewConsumer(config config.QueueConfig) (*Consumer, error) {
+	source, err := NewSource(config)
+	if err != nil {
+		return nil, err
+	}
+	return newConsumer(source), nil
+}
+
+func newConsumer(source Source) *Consumer {
+	return &Consumer{
+		source:  source,
+		offsets: make(map[topicPartition]*partitionOffsets),
+		paused:  make(map[string]bool),
+	}
+}
+
+// Pause stops fetching new messages until Resume is called with the same
+// reason. Consumption only continues once every reason has been resumed.
+// Messages that were already fetched are not affected.
+func (c *Consumer) Pause(reason string) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if c.paused[reason] {
+		return
+	}
+	if len(c.paused) == 0 {
+		c.resumed = make(chan struct{})
+	}
+	c.paused[reason] = true
+	log.Printf("Consumer paused: %s\n", reason)
+}
+
+// Resume lifts a pause requested with reason.
+func (c *Consumer) Resume(reason string) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if !c.paused[reason] {
+		return
+	}
+	delete(c.paused, reason)
+	log.Printf("Consumer resumed: %s\n", reason)
+	if len(c.paused) == 0 {
+		close(c.resumed)
+	}
+}
+
+// Paused reports whether consumption is paused for reason.
+func (c *Consumer) Paused(reason string) bool {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	return c.paused[reason]
+}
+
+// PauseReasons returns the reasons consumption is currently paused for.
+func (c *Consumer) PauseReasons() []string {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	reasons := make([]string, 0, len(c.paused))
+	for reason := range c.paused {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// waitResumed blocks while consumption is paused or until ctx is done.
+func (c *Consumer) waitResumed(ctx context.Context) {
+	c.pauseMu.Lock()
+	resumed := c.resumed
+	paused := len(c.paused) > 0
+	c.pauseMu.Unlock()
+
+	if paused {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+	}
 }
 
-func (c *Consumer) Messages() <-chan string {
-	out := make(chan string)
+// Messages fetches messages without committing them. Every message received
+// from the channel must be passed to Ack once it has been handled, otherwise
+// its offset and all later offsets of the same partition stay uncommitted.
+// The channel is closed once ctx is done. Every message continues the trace
+// of its traceparent header, or starts a new one, with a receive span.
+func (c *Consumer) Messages(ctx context.Context) <-chan Message {
+	out := make(chan Message)
 	go func() {
 		defer close(out)
 		for {
-			msg, err := c.reader.ReadMessage(context.Background())
+			c.waitResumed(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			msg, err := c.source.Fetch(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
 				log.Printf("Error reading message: %v\n", err)
 				continue
 			}
-			out <- string(msg.Value)
+			c.track(msg)
+			metrics.MessagesConsumed.Inc()
+			msg = receive(msg)
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				// Never handed out, so never committed: the message is
+				// redelivered after a restart.
+				return
+			}
 		}
 	}()
 	return out
 }
+
+// Ack marks a message as handled and commits the highest offset of its
+// partition below which every fetched message has been handled. Messages may
+// be acked in any order; commits for a partition never skip a message that
+// is still in flight.
+func (c *Consumer) Ack(msg Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.offsets[topicPartition{msg.Topic, msg.Partition}]
+	if !ok {
+		return nil
+	}
+	p.done[msg.Offset] = true
+
+	commit := int64(-1)
+	for len(p.pending) > 0 && p.done[p.pending[0]] {
+		commit = p.pending[0]
+		delete(p.done, commit)
+		p.pending = p.pending[1:]
+	}
+	if commit < 0 {
+		return nil
+	}
+
+	// Committing while holding the lock keeps commits for a partition in
+	// offset order.
+	return c.source.Commit(context.Background(), Message{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    commit,
+	})
+}
+
+// Source returns the queue backend.
+func (c *Consumer) Source() Source {
+	return c.source
+}
+
+// Ping checks that the queue backend is reachable.
+func (c *Consumer) Ping(ctx context.Context) error {
+	return c.source.Ping(ctx)
+}
+
+// Lag returns the consumer lag reported by the queue backend.
+func (c *Consumer) Lag() int64 {
+	return c.source.Lag()
+}
+
+// PartitionLag returns, per partition, how many messages the last fetched
+// message was behind the partition's high-water mark.
+func (c *Consumer) PartitionLag() map[int]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lag := make(map[int]int64, len(c.offsets))
+	for key, p := range c.offsets {
+		lag[key.partition] = p.lag
+	}
+	return lag
+}
+
+// Unacked returns the number of fetched messages whose offsets have not been
+// committed yet.
+func (c *Consumer) Unacked() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, p := range c.offsets {
+		n += len(p.pending)
+	}
+	return n
+}
+
+// Close closes the queue backend.
+func (c *Consumer) Close() error {
+	return c.source.Close()
+}
+
+func (c *Consumer) track(msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := topicPartition{msg.Topic, msg.Partition}
+	p, ok := c.offsets[key]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool)}
+		c.offsets[key] = p
+	}
+	p.pending = append(p.pending, msg.Offset)
+	if msg.HighWaterMark > 0 {
+		p.lag = msg.HighWaterMark - msg.Offset - 1
+	}
+}
@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeReader serves a fixed list of messages and records every commit. Once
+// the list is exhausted FetchMessage blocks until ctx is done, like a reader
+// waiting on an idle partition.
+type fakeReader struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	commits  []kafka.Message
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.messages) == 0 {
+		r.mu.Unlock()
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	defer r.mu.Unlock()
+	msg := r.messages[0]
+	r.messages = r.messages[1:]
+	return msg, nil
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commits = append(r.commits, msgs...)
+	return nil
+}
+
+func (r *fakeReader) Stats() kafka.ReaderStats { return kafka.ReaderStats{} }
+
+func (r *fakeReader) Close() error { return nil }
+
+func (r *fakeReader) committed() []kafka.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]kafka.Message(nil), r.commits...)
+}
+
+func msg(partition int, offset int64) kafka.Message {
+	return kafka.Message{Topic: "my-topic", Partition: partition, Offset: offset}
+}
+
+// fetchAll fetches and tracks n messages the same way Messages does. The
+// context is already cancelled so that a missing message fails the test
+// instead of blocking it.
+func fetchAll(t *testing.T, c *Consumer, n int) []Message {
+	t.Helper()
+	var out []Message
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		m, err := c.source.Fetch(ctx)
+		if err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+		c.track(m)
+		out = append(out, m)
+	}
+	return out
+}
+
+func assertCommits(t *testing.T, got []kafka.Message, want ...kafka.Message) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d commits %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i].Partition != want[i].Partition || got[i].Offset != want[i].Offset {
+			t.Fatalf("commit %d: got partition %d offset %d, want partition %d offset %d",
+				i, got[i].Partition, got[i].Offset, want[i].Partition, want[i].Offset)
+		}
+	}
+}
+
+func TestAckCommitsInOrderWithinPartition(t *testing.T) {
+	reader := &fakeReader{messages: []kafka.Message{msg(0, 10), msg(0, 11), msg(0, 12)}}
+	c := newConsumer(&KafkaSource{reader: reader})
+	fetched := fetchAll(t, c, 3)
+
+	// Finishing the later deliveries first must not commit past offset 10.
+	if err := c.Ack(fetched[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ack(fetched[1]); err != nil {
+		t.Fatal(err)
+	}
+	assertCommits(t, reader.committed())
+
+	// Once offset 10 is done everything up to 12 can be committed at once.
+	if err := c.Ack(fetched[0]); err != nil {
+		t.Fatal(err)
+	}
+	assertCommits(t, reader.committed(), msg(0, 12))
+}
+
+func TestAckCommitsContiguousPrefixOnly(t *testing.T) {
+	reader := &fakeReader{messages: []kafka.Message{msg(0, 1), msg(0, 2), msg(0, 3), msg(0, 4)}}
+	c := newConsumer(&KafkaSource{reader: reader})
+	fetched := fetchAll(t, c, 4)
+
+	for _, i := range []int{0, 2, 1} {
+		if err := c.Ack(fetched[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Offset 4 is still in flight.
+	assertCommits(t, reader.committed(), msg(0, 1), msg(0, 3))
+}
+
+func TestAckPartitionsAreIndependent(t *testing.T) {
+	reader := &fakeReader{messages: []kafka.Message{msg(0, 5), msg(1, 7), msg(0, 6), msg(1, 8)}}
+	c := newConsumer(&KafkaSource{reader: reader})
+	fetched := fetchAll(t, c, 4)
+
+	// A stuck message on partition 0 must not hold back partition 1.
+	if err := c.Ack(fetched[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ack(fetched[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ack(fetched[2]); err != nil {
+		t.Fatal(err)
+	}
+	assertCommits(t, reader.committed(), msg(1, 7), msg(1, 8))
+
+	if err := c.Ack(fetched[0]); err != nil {
+		t.Fatal(err)
+	}
+	assertCommits(t, reader.committed(), msg(1, 7), msg(1, 8), msg(0, 6))
+}
+
+func TestMessagesDoesNotCommit(t *testing.T) {
+	reader := &fakeReader{messages: []kafka.Message{msg(0, 1), msg(0, 2)}}
+	c := newConsumer(&KafkaSource{reader: reader})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := c.Messages(ctx)
+	first := <-messages
+	<-messages
+	assertCommits(t, reader.committed())
+
+	if err := c.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+	assertCommits(t, reader.committed(), msg(0, 1))
+}
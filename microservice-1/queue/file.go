@@ -0,0 +1,257 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLineSize is the longest NDJSON line FileSource accepts.
+const maxLineSize = 1024 * 1024
+
+// FileSource reads messages from newline-delimited JSON files in a
+// directory, for local development. Files matching *.ndjson are read one at
+// a time in name order and every non-empty line is one message. Each file
+// gets its own partition number and the line index as offset. Since both
+// start over with every run and file, every message also gets a
+// HeaderMessageID made of the file name, line index and a hash of the line.
+//
+// Commits are kept in a <file>.offset file so that a restart resumes after
+// the last committed line. Once every line of a file has been committed the
+// file is renamed to <file>.done.
+type FileSource struct {
+	topic        string
+	dir          string
+	pollInterval time.Duration
+
+	mu            sync.Mutex
+	current       *ndjsonFile         // File being read, nil between files
+	files         map[int]*ndjsonFile // Files with uncommitted messages, by partition
+	opened        map[string]bool     // Paths handed out a partition already
+	nextPartition int
+}
+
+// ndjsonFile is the read and commit state of one input file.
+type ndjsonFile struct {
+	path      string
+	partition int
+	file      *os.File
+	scanner   *bufio.Scanner
+	next      int64 // Offset of the next message to be read
+	committed int64 // Last committed offset, -1 if none
+	eof       bool
+}
+
+// NewFileSource returns a source reading *.ndjson files from dir, looking
+// for new files every pollInterval.
+func NewFileSource(topic, dir string, pollInterval time.Duration) (*FileSource, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory %s: %w", dir, err)
+	}
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	return &FileSource{
+		topic:        topic,
+		dir:          dir,
+		pollInterval: pollInterval,
+		files:        make(map[int]*ndjsonFile),
+		opened:       make(map[string]bool),
+	}, nil
+}
+
+func (s *FileSource) Fetch(ctx context.Context) (Message, error) {
+	for {
+		msg, ok, err := s.next()
+		if err != nil || ok {
+			return msg, err
+		}
+
+		// Nothing to read: wait for new files
+		timer := time.NewTimer(s.pollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+// next returns the next message, opening the next file when needed. ok is
+// false when no file has anything left to read.
+func (s *FileSource) next() (Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.current == nil {
+			f, err := s.openNext()
+			if err != nil || f == nil {
+				return Message{}, false, err
+			}
+			s.current = f
+		}
+
+		f := s.current
+		for f.scanner.Scan() {
+			line := bytes.TrimSpace(f.scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			offset := f.next
+			f.next++
+			if offset <= f.committed {
+				// Committed before a restart
+				continue
+			}
+			return Message{
+				Topic:     s.topic,
+				Partition: f.partition,
+				Offset:    offset,
+				Value:     append([]byte(nil), line...),
+				Headers:   []Header{{Key: HeaderMessageID, Value: []byte(lineID(f.path, offset, line))}},
+				Time:      time.Now(),
+			}, true, nil
+		}
+		if err := f.scanner.Err(); err != nil {
+			return Message{}, false, fmt.Errorf("failed to read %s: %w", f.path, err)
+		}
+
+		f.eof = true
+		f.file.Close()
+		s.current = nil
+		if err := s.finishIfDone(f); err != nil {
+			return Message{}, false, err
+		}
+	}
+}
+
+// openNext opens the first *.ndjson file that was not opened before, or
+// returns nil if there is none. s.mu must be held.
+func (s *FileSource) openNext() (*ndjsonFile, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if s.opened[path] {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		committed, err := readCommittedOffset(path)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		f := &ndjsonFile{
+			path:      path,
+			partition: s.nextPartition,
+			file:      file,
+			scanner:   scanner,
+			committed: committed,
+		}
+		s.nextPartition++
+		s.opened[path] = true
+		s.files[f.partition] = f
+		return f, nil
+	}
+	return nil, nil
+}
+
+func (s *FileSource) Commit(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[msg.Partition]
+	if !ok {
+		return fmt.Errorf("unknown partition %d", msg.Partition)
+	}
+	f.committed = msg.Offset
+	if err := os.WriteFile(f.path+".offset", []byte(strconv.FormatInt(f.committed, 10)), 0o644); err != nil {
+		return err
+	}
+	return s.finishIfDone(f)
+}
+
+// finishIfDone renames a file that was read and committed completely to
+// <file>.done. s.mu must be held.
+func (s *FileSource) finishIfDone(f *ndjsonFile) error {
+	if !f.eof || f.committed < f.next-1 {
+		return nil
+	}
+	delete(s.files, f.partition)
+	delete(s.opened, f.path)
+	if err := os.Rename(f.path, f.path+".done"); err != nil {
+		return err
+	}
+	if err := os.Remove(f.path + ".offset"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Ping checks that the directory is accessible.
+func (s *FileSource) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+// Lag is not tracked for files and always returns 0.
+func (s *FileSource) Lag() int64 {
+	return 0
+}
+
+func (s *FileSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		s.current.file.Close()
+		s.current = nil
+	}
+	return nil
+}
+
+// lineID returns the HeaderMessageID of the line at offset of the file at
+// path. The hash tells apart lines of a file that reuses the name of an
+// earlier one.
+func lineID(path string, offset int64, line []byte) string {
+	sum := sha256.Sum256(line)
+	return fmt.Sprintf("file-%s-%d-%s", filepath.Base(path), offset, hex.EncodeToString(sum[:8]))
+}
+
+// readCommittedOffset returns the offset stored next to path, or -1.
+func readCommittedOffset(path string) (int64, error) {
+	data, err := os.ReadFile(path + ".offset")
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
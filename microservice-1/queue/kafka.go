@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"context"
+
+	"microservice-1/config"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Reader is the subset of *kafka.Reader used by KafkaSource.
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Stats() kafka.ReaderStats
+	Close() error
+}
+
+// KafkaSource consumes a Kafka topic as part of a consumer group.
+type KafkaSource struct {
+	reader Reader
+	broker string
+}
+
+// NewKafkaSource creates a reader for config.Topic in group config.GroupID.
+// Offsets are only committed through Commit.
+func NewKafkaSource(config config.QueueConfig) *KafkaSource {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{config.Broker},
+		Topic:   config.Topic,
+		GroupID: config.GroupID,
+	})
+	return &KafkaSource{reader: reader, broker: config.Broker}
+}
+
+func (s *KafkaSource) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return fromKafka(msg), nil
+}
+
+func (s *KafkaSource) Commit(ctx context.Context, msg Message) error {
+	return s.reader.CommitMessages(ctx, kafka.Message{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+	})
+}
+
+// Ping checks that the Kafka broker accepts connections.
+func (s *KafkaSource) Ping(ctx context.Context) error {
+	conn, err := kafka.DialContext(ctx, "tcp", s.broker)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Lag returns the consumer lag reported by kafka.Reader.Stats(). In a
+// consumer group the reader reports one value for all partitions.
+func (s *KafkaSource) Lag() int64 {
+	return s.reader.Stats().Lag
+}
+
+func (s *KafkaSource) Close() error {
+	return s.reader.Close()
+}
@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemorySource is an in-process Source backed by a channel, for tests and
+// for running Microservice-1 without a broker. Every message is published
+// to partition 0 of its topic unless Publish is given another partition.
+// Offsets start at 0 with every MemorySource, so messages also get a
+// HeaderMessageID unique to the source.
+type MemorySource struct {
+	topic    string
+	run      string // Random ID of this source, part of every HeaderMessageID
+	messages chan Message
+
+	publishMu sync.Mutex // Keeps offsets in channel order
+
+	mu        sync.Mutex
+	next      map[int]int64 // Next offset per partition
+	committed map[int]int64 // Last committed offset per partition
+}
+
+// NewMemorySource returns a source for topic buffering up to buffer
+// published messages.
+func NewMemorySource(topic string, buffer int) *MemorySource {
+	if buffer < 0 {
+		buffer = 0
+	}
+	return &MemorySource{
+		topic:     topic,
+		run:       newRunID(),
+		messages:  make(chan Message, buffer),
+		next:      make(map[int]int64),
+		committed: make(map[int]int64),
+	}
+}
+
+// Publish assigns the next offset of their partition to msgs and queues
+// them. It blocks while the buffer is full or until ctx is done, and returns
+// the messages as they will be fetched. Publish implements Publisher.
+func (s *MemorySource) Publish(ctx context.Context, msgs ...Message) ([]Message, error) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	published := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		msg, err := s.publish(ctx, msg)
+		if err != nil {
+			return published, err
+		}
+		published = append(published, msg)
+	}
+	return published, nil
+}
+
+// publish queues one message. s.publishMu must be held.
+func (s *MemorySource) publish(ctx context.Context, msg Message) (Message, error) {
+	s.mu.Lock()
+	if msg.Topic == "" {
+		msg.Topic = s.topic
+	}
+	msg.Offset = s.next[msg.Partition]
+	msg.HighWaterMark = msg.Offset + 1
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	if _, ok := msg.Header(HeaderMessageID); !ok {
+		id := fmt.Sprintf("memory-%s-%d-%d", s.run, msg.Partition, msg.Offset)
+		msg.Headers = append(append([]Header(nil), msg.Headers...), Header{Key: HeaderMessageID, Value: []byte(id)})
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.messages <- msg:
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+
+	s.mu.Lock()
+	s.next[msg.Partition]++
+	s.mu.Unlock()
+	return msg, nil
+}
+
+func (s *MemorySource) Fetch(ctx context.Context) (Message, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (s *MemorySource) Commit(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed[msg.Partition] = msg.Offset
+	return nil
+}
+
+// Committed returns the last committed offset of partition, or -1.
+func (s *MemorySource) Committed(partition int) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset, ok := s.committed[partition]; ok {
+		return offset
+	}
+	return -1
+}
+
+func (s *MemorySource) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Lag returns the number of published messages not fetched yet.
+func (s *MemorySource) Lag() int64 {
+	return int64(len(s.messages))
+}
+
+func (s *MemorySource) Close() error {
+	return nil
+}
+
+// newRunID returns a random hex ID.
+func newRunID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Fall back to the clock, which is unique enough for a single process
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
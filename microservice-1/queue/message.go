@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Header is a Kafka record header.
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Message is a message consumed from the queue, together with the Kafka
+// metadata needed for ordering, idempotency, tracing and auditing.
+type Message struct {
+	Topic         string
+	Partition     int
+	Offset        int64
+	HighWaterMark int64 // Offset of the next message to be written to the partition, if known
+	Key           []byte
+	Value         []byte
+	Headers       []Header
+	Time          time.Time
+}
+
+// Header returns the value of the last header named key.
+func (m Message) Header(key string) (string, bool) {
+	for i := len(m.Headers) - 1; i >= 0; i-- {
+		if m.Headers[i].Key == key {
+			return string(m.Headers[i].Value), true
+		}
+	}
+	return "", false
+}
+
+// LaneKey returns the key that keeps messages in order when they are
+// processed concurrently: the Kafka message key, or the partition for
+// messages without one.
+func (m Message) LaneKey() string {
+	if len(m.Key) > 0 {
+		return string(m.Key)
+	}
+	return "partition-" + strconv.Itoa(m.Partition)
+}
+
+// fromKafka converts a record fetched by kafka-go.
+func fromKafka(msg kafka.Message) Message {
+	headers := make([]Header, len(msg.Headers))
+	for i, h := range msg.Headers {
+		headers[i] = Header{Key: h.Key, Value: h.Value}
+	}
+	return Message{
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		HighWaterMark: msg.HighWaterMark,
+		Key:           msg.Key,
+		Value:         msg.Value,
+		Headers:       headers,
+		Time:          msg.Time,
+	}
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMessageHeader(t *testing.T) {
+	msg := Message{Headers: []Header{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+		{Key: "a", Value: []byte("3")},
+		{Key: "empty", Value: nil},
+	}}
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"a", "3", true},
+		{"b", "2", true},
+		{"empty", "", true},
+		{"A", "", false},
+		{"missing", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := msg.Header(tt.key)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Header(%q) = %q, %v, want %q, %v", tt.key, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFromKafka(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	got := fromKafka(kafka.Message{
+		Topic:         "events",
+		Partition:     2,
+		Offset:        41,
+		HighWaterMark: 50,
+		Key:           []byte("user-1"),
+		Value:         []byte(`{"id":1}`),
+		Headers:       []kafka.Header{{Key: "traceparent", Value: []byte("00-abc")}},
+		Time:          at,
+	})
+	want := Message{
+		Topic:         "events",
+		Partition:     2,
+		Offset:        41,
+		HighWaterMark: 50,
+		Key:           []byte("user-1"),
+		Value:         []byte(`{"id":1}`),
+		Headers:       []Header{{Key: "traceparent", Value: []byte("00-abc")}},
+		Time:          at,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("fromKafka() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReplayHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []kafka.Header
+		want    []kafka.Header
+	}{
+		{
+			name:    "no dead-letter headers",
+			headers: []kafka.Header{{Key: "traceparent", Value: []byte("00-abc")}},
+			want:    []kafka.Header{{Key: "traceparent", Value: []byte("00-abc")}},
+		},
+		{
+			name: "restricts to the failed destination",
+			headers: []kafka.Header{
+				{Key: "traceparent", Value: []byte("00-abc")},
+				{Key: HeaderDestination, Value: []byte("orders/old")},
+				{Key: "x-dlq-reason", Value: []byte("HTTP 400")},
+				{Key: HeaderDLQDestination, Value: []byte("orders/audit")},
+			},
+			want: []kafka.Header{
+				{Key: "traceparent", Value: []byte("00-abc")},
+				{Key: HeaderDestination, Value: []byte("orders/audit")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ReplayHeaders(tt.headers); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReplayHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
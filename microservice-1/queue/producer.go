@@ -0,0 +1,229 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"microservice-1/config"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers added to records published to the dead-letter topic.
+const (
+	HeaderDLQError             = "x-dlq-error"
+	HeaderDLQAttempts          = "x-dlq-attempts"
+	HeaderDLQOriginalTopic     = "x-dlq-original-topic"
+	HeaderDLQOriginalPartition = "x-dlq-original-partition"
+	HeaderDLQOriginalOffset    = "x-dlq-original-offset"
+	HeaderDLQFailedAt          = "x-dlq-failed-at"
+	HeaderDLQRoute             = "x-dlq-route"
+	HeaderDLQDestination       = "x-dlq-destination"
+)
+
+// HeaderDestination restricts the delivery of a message to the destination
+// of that name within its route. ReplayHeaders sets it so that a re-published
+// dead-letter record only goes to the destination that failed.
+const HeaderDestination = "x-relay-destination"
+
+// HeaderMessageID carries an ID that identifies a message for good. The
+// memory and file backends set it since their partitions and offsets start
+// over with every run or file; Kafka records are identified by topic,
+// partition and offset instead.
+const HeaderMessageID = "x-relay-message-id"
+
+// dlqHeaderPrefix is shared by all headers added by DeadLetterProducer.
+const dlqHeaderPrefix = "x-dlq-"
+
+// DeadLetterProducer publishes permanently failed messages to a dead-letter
+// topic so that other teams can consume the failures.
+type DeadLetterProducer struct {
+	writer *kafka.Writer
+}
+
+// NewDeadLetterProducer returns a producer for config.DeadLetterTopic, or nil
+// if no dead-letter topic is configured.
+func NewDeadLetterProducer(config config.QueueConfig) *DeadLetterProducer {
+	if config.DeadLetterTopic == "" {
+		return nil
+	}
+	return &DeadLetterProducer{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(config.Broker),
+			Topic:                  config.DeadLetterTopic,
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+	}
+}
+
+// Publish writes msg to the dead-letter topic with its original key and
+// headers, adding headers for the error, the attempt count, the original
+// position and the route and destination that failed.
+func (p *DeadLetterProducer) Publish(ctx context.Context, msg Message, route, destination, reason string, attempts int) error {
+	headers := append(toKafkaHeaders(msg.Headers),
+		kafka.Header{Key: HeaderDLQError, Value: []byte(reason)},
+		kafka.Header{Key: HeaderDLQAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderDLQOriginalTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderDLQOriginalPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderDLQOriginalOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderDLQFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+		kafka.Header{Key: HeaderDLQRoute, Value: []byte(route)},
+		kafka.Header{Key: HeaderDLQDestination, Value: []byte(destination)},
+	)
+
+	return p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+}
+
+// Close flushes pending writes and closes the producer.
+func (p *DeadLetterProducer) Close() error {
+	return p.writer.Close()
+}
+
+// ReplayHeaders returns the headers of a dead-letter record to re-publish it
+// with: the headers of the original record, without the ones added by
+// DeadLetterProducer, plus HeaderDestination naming the destination that
+// failed.
+func ReplayHeaders(headers []kafka.Header) []kafka.Header {
+	original := make([]kafka.Header, 0, len(headers))
+	var destination []byte
+	for _, h := range headers {
+		switch {
+		case h.Key == HeaderDLQDestination:
+			destination = h.Value
+		case h.Key == HeaderDestination, strings.HasPrefix(h.Key, dlqHeaderPrefix):
+		default:
+			original = append(original, h)
+		}
+	}
+	if len(destination) > 0 {
+		original = append(original, kafka.Header{Key: HeaderDestination, Value: destination})
+	}
+	return original
+}
+
+// Publisher publishes messages to the main topic.
+type Publisher interface {
+	// Publish writes msgs and returns them with Topic, Partition and Offset
+	// set as assigned by the backend.
+	Publish(ctx context.Context, msgs ...Message) ([]Message, error)
+	Close() error
+}
+
+// NewPublisher returns a publisher for the main topic of the backend
+// selected in config. The memory backend publishes into source, which must
+// then be the *MemorySource consumed by Microservice-1; every other backend
+// publishes to Kafka.
+func NewPublisher(config config.QueueConfig, source Source) (Publisher, error) {
+	if config.Backend == "memory" {
+		memory, ok := source.(*MemorySource)
+		if !ok {
+			return nil, fmt.Errorf("memory backend requires a *MemorySource, got %T", source)
+		}
+		return memory, nil
+	}
+
+	acks, err := parseRequiredAcks(config.ProducerAcks)
+	if err != nil {
+		return nil, err
+	}
+	return NewProducer(config, acks), nil
+}
+
+// Producer publishes messages to the main Kafka topic. Concurrent calls to
+// Publish are batched into produce requests of up to ProducerBatchSize
+// messages, waiting at most ProducerBatchTimeout for a batch to fill.
+type Producer struct {
+	writer *kafka.Writer
+}
+
+// NewProducer returns a producer for config.Topic that waits for acks.
+func NewProducer(config config.QueueConfig, acks kafka.RequiredAcks) *Producer {
+	return &Producer{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(config.Broker),
+			Topic:                  config.Topic,
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           acks,
+			BatchSize:              config.ProducerBatchSize,
+			BatchTimeout:           config.ProducerBatchTimeout,
+			AllowAutoTopicCreation: true,
+			Completion:             recordPosition,
+		},
+	}
+}
+
+// recordPosition copies the partition and offset assigned by Kafka to the
+// message each written record points to through WriterData.
+func recordPosition(written []kafka.Message, err error) {
+	if err != nil {
+		return
+	}
+	for _, w := range written {
+		if msg, ok := w.WriterData.(*Message); ok {
+			msg.Topic = w.Topic
+			msg.Partition = w.Partition
+			msg.Offset = w.Offset
+			msg.Time = w.Time
+		}
+	}
+}
+
+// Publish writes msgs synchronously. It returns once Kafka acknowledged all
+// of them as configured by the required acks.
+func (p *Producer) Publish(ctx context.Context, msgs ...Message) ([]Message, error) {
+	published := make([]Message, len(msgs))
+	records := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		published[i] = msg
+		published[i].Offset = -1
+		records[i] = kafka.Message{
+			Key:        msg.Key,
+			Value:      msg.Value,
+			Headers:    toKafkaHeaders(msg.Headers),
+			WriterData: &published[i],
+		}
+	}
+
+	// WriteMessages blocks until the Completion function has run
+	if err := p.writer.WriteMessages(ctx, records...); err != nil {
+		return nil, err
+	}
+	return published, nil
+}
+
+// Close flushes pending writes and closes the producer.
+func (p *Producer) Close() error {
+	return p.writer.Close()
+}
+
+// parseRequiredAcks converts "all", "one" or "none".
+func parseRequiredAcks(value string) (kafka.RequiredAcks, error) {
+	switch value {
+	case "", "all":
+		return kafka.RequireAll, nil
+	case "one":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	default:
+		return 0, fmt.Errorf("unknown producer acks %q", value)
+	}
+}
+
+// toKafkaHeaders converts headers for kafka-go.
+func toKafkaHeaders(headers []Header) []kafka.Header {
+	result := make([]kafka.Header, 0, len(headers))
+	for _, h := range headers {
+		result = append(result, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+	return result
+}
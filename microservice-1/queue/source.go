@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+
+	"microservice-1/config"
+)
+
+// Source is a queue backend that Consumer fetches messages from.
+type Source interface {
+	// Fetch blocks until the next message is available or ctx is done.
+	Fetch(ctx context.Context) (Message, error)
+	// Commit marks msg and every earlier message of the same topic and
+	// partition as handled. Only Topic, Partition and Offset of msg are set.
+	Commit(ctx context.Context, msg Message) error
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	// Lag returns how many messages are waiting to be fetched, as far as
+	// the backend knows.
+	Lag() int64
+	Close() error
+}
+
+// NewSource creates the backend selected by config.Backend: "kafka" (the
+// default), "memory" or "file".
+func NewSource(config config.QueueConfig) (Source, error) {
+	switch config.Backend {
+	case "", "kafka":
+		return NewKafkaSource(config), nil
+	case "memory":
+		return NewMemorySource(config.Topic, config.MemoryBuffer), nil
+	case "file":
+		return NewFileSource(config.Topic, config.FileDir, config.FilePollInterval)
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", config.Backend)
+	}
+}
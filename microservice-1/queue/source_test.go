@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySourceMessageIDsDifferAcrossRuns(t *testing.T) {
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	for run := 0; run < 2; run++ {
+		source := NewMemorySource("events", 2)
+		published, err := source.Publish(ctx, Message{Value: []byte("a")}, Message{Value: []byte("b")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range published {
+			id, ok := msg.Header(HeaderMessageID)
+			if !ok {
+				t.Fatalf("offset %d has no %s header", msg.Offset, HeaderMessageID)
+			}
+			if seen[id] {
+				t.Fatalf("run %d reused message ID %q", run, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestMemorySourceKeepsGivenMessageID(t *testing.T) {
+	source := NewMemorySource("events", 1)
+	published, err := source.Publish(context.Background(), Message{
+		Value:   []byte("a"),
+		Headers: []Header{{Key: HeaderMessageID, Value: []byte("given")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := published[0].Header(HeaderMessageID); id != "given" {
+		t.Fatalf("message ID = %q, want given", id)
+	}
+}
+
+func TestFileSourceMessageIDs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetchIDs := func(n int) []string {
+		source, err := NewFileSource("events", dir, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer source.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var ids []string
+		for i := 0; i < n; i++ {
+			msg, err := source.Fetch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := msg.Header(HeaderMessageID)
+			ids = append(ids, id)
+			if err := source.Commit(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ids
+	}
+
+	// A second file starts at partition 0 and offset 0 again after a
+	// restart, but must not get the IDs of the first one
+	write("a.ndjson", "{\"n\":1}\n{\"n\":2}\n")
+	first := fetchIDs(2)
+	write("b.ndjson", "{\"n\":1}\n")
+	second := fetchIDs(1)
+	// A file reusing the name of a finished one must not either
+	write("a.ndjson", "{\"n\":3}\n")
+	third := fetchIDs(1)
+
+	seen := make(map[string]bool)
+	for _, id := range append(append(first, second...), third...) {
+		if id == "" || seen[id] {
+			t.Fatalf("message IDs %v %v %v are not unique", first, second, third)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("microservice-1/queue")
+
+// headerCarrier adapts record headers to the OpenTelemetry propagators, so
+// that W3C traceparent and tracestate travel in Kafka headers.
+type headerCarrier struct {
+	headers *[]Header
+}
+
+// Get returns the value of the last header named key.
+func (c headerCarrier) Get(key string) string {
+	value, _ := Message{Headers: *c.headers}.Header(key)
+	return value
+}
+
+// Set replaces every header named key with one holding value.
+func (c headerCarrier) Set(key, value string) {
+	headers := make([]Header, 0, len(*c.headers)+1)
+	for _, h := range *c.headers {
+		if h.Key != key {
+			headers = append(headers, h)
+		}
+	}
+	*c.headers = append(headers, Header{Key: key, Value: []byte(value)})
+}
+
+// Keys returns the header names.
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, len(*c.headers))
+	for i, h := range *c.headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// TraceContext returns ctx carrying the trace context of the message
+// headers. Spans started from it belong to the trace of the message, also
+// when the message is delivered again from failed_messages or retry_jobs.
+func (m Message) TraceContext(ctx context.Context) context.Context {
+	headers := m.Headers
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier{&headers})
+}
+
+// receive records a span for fetching msg, continuing the trace of its
+// traceparent header or starting a new trace, and returns msg with its
+// trace headers pointing at that span.
+func receive(msg Message) Message {
+	_, span := tracer.Start(msg.TraceContext(context.Background()), msg.Topic+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.String("messaging.kafka.destination.partition", strconv.Itoa(msg.Partition)),
+			attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+		))
+	defer span.End()
+
+	headers := append([]Header(nil), msg.Headers...)
+	otel.GetTextMapPropagator().Inject(trace.ContextWithSpan(context.Background(), span), headerCarrier{&headers})
+	msg.Headers = headers
+	return msg
+}
@@ -0,0 +1,91 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"microservice-1/breaker"
+	"microservice-1/db"
+	"microservice-1/queue"
+)
+
+var tracer = otel.Tracer("microservice-1/retry")
+
+// sendAttempt makes delivery attempt number n of message to destination and
+// waits for its outcome, see startAttempt.
+func (r *RetryHandler) sendAttempt(ctx context.Context, destination *Destination, message queue.Message, n int) error {
+	return r.startAttempt(ctx, destination, message, n)()
+}
+
+// startAttempt starts delivery attempt number n of message to destination,
+// see startSend, in a span of the trace of message, and returns a function
+// that waits for its outcome. The trace context is passed on to the
+// destination in the traceparent header. Every attempt that was let through
+// the circuit breaker is recorded in delivery_attempts.
+func (r *RetryHandler) startAttempt(ctx context.Context, destination *Destination, message queue.Message, n int) func() error {
+	ctx, span := tracer.Start(message.TraceContext(ctx), "deliver "+destination.ID(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("relay.route", destination.Route),
+			attribute.String("relay.destination", destination.Name),
+			attribute.Int("relay.attempt", n),
+			attribute.String("url.full", destination.URL),
+		))
+	start := time.Now()
+	wait := r.startSend(ctx, destination, message)
+	return func() error {
+		defer span.End()
+		err := wait()
+		r.recordAttempt(span, destination, message, n, start, err)
+		return err
+	}
+}
+
+// recordAttempt adds the outcome of attempt number n, started at start, to
+// its span and to delivery_attempts.
+func (r *RetryHandler) recordAttempt(span trace.Span, destination *Destination, message queue.Message, n int, start time.Time, err error) {
+	attempt := db.DeliveryAttempt{
+		MessageID:   r.MessageID(message),
+		Topic:       message.Topic,
+		Partition:   message.Partition,
+		Offset:      message.Offset,
+		Route:       destination.Route,
+		Destination: destination.Name,
+		URL:         destination.URL,
+		Attempt:     n,
+		LatencyMS:   time.Since(start).Milliseconds(),
+	}
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		attempt.StatusCode = http.StatusOK
+	case errors.As(err, &statusErr):
+		attempt.StatusCode = statusErr.StatusCode
+		attempt.Response = statusErr.Body
+		if attempt.Response == "" {
+			attempt.Response = statusErr.Detail
+		}
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if attempt.StatusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", attempt.StatusCode))
+	}
+
+	if !errors.Is(err, breaker.ErrOpen) {
+		if recordErr := r.db.RecordDeliveryAttempt(attempt); recordErr != nil {
+			log.Printf("Failed to record delivery attempt to %s: %v\n", destination.ID(), recordErr)
+		}
+	}
+}
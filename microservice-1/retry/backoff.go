@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"microservice-1/config"
+)
+
+// Backoff computes how long to wait before the next delivery attempt.
+type Backoff interface {
+	// Next returns the delay after the given failed attempt (starting at 1).
+	// prev is the delay returned for the previous attempt, zero at first.
+	Next(attempt int, prev time.Duration) time.Duration
+}
+
+// FixedBackoff waits the same delay between all attempts.
+type FixedBackoff struct {
+	Delay time.Duration
+}
+
+func (b FixedBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	return b.Delay
+}
+
+// ExponentialBackoff doubles the delay after every attempt, starting at
+// Initial and capped at Max.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+func (b ExponentialBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	delay := b.Initial
+	for i := 1; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// DecorrelatedJitterBackoff picks a random delay between Base and three times
+// the previous delay, capped at Max. Spreading the retries out keeps workers
+// from hitting Microservice-2 in lockstep after an outage.
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b DecorrelatedJitterBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	if prev < b.Base {
+		prev = b.Base
+	}
+	upper := 3 * prev
+	delay := b.Base
+	if upper > b.Base {
+		delay += time.Duration(rand.Int63n(int64(upper - b.Base)))
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// NewBackoff builds the strategy named by policy.Backoff: "fixed",
+// "exponential" or "decorrelated". Delay is the fixed, initial or base delay
+// respectively and MaxDelay caps the other two.
+func NewBackoff(policy config.RetryPolicy) (Backoff, error) {
+	delay := time.Duration(policy.Delay)
+	maxDelay := time.Duration(policy.MaxDelay)
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+
+	switch policy.Backoff {
+	case "", "fixed":
+		return FixedBackoff{Delay: delay}, nil
+	case "exponential":
+		return ExponentialBackoff{Initial: delay, Max: maxDelay}, nil
+	case "decorrelated":
+		return DecorrelatedJitterBackoff{Base: delay, Max: maxDelay}, nil
+	default:
+		return nil, fmt.Errorf("unknown backoff strategy %q", policy.Backoff)
+	}
+}
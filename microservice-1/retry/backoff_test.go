@@ -0,0 +1,184 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"microservice-1/config"
+)
+
+func TestNewBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  config.RetryPolicy
+		want    Backoff
+		wantErr bool
+	}{
+		{"default is fixed", config.RetryPolicy{Delay: config.Duration(time.Second)}, FixedBackoff{Delay: time.Second}, false},
+		{"fixed", config.RetryPolicy{Backoff: "fixed", Delay: config.Duration(time.Second)}, FixedBackoff{Delay: time.Second}, false},
+		{
+			"exponential",
+			config.RetryPolicy{Backoff: "exponential", Delay: config.Duration(time.Second), MaxDelay: config.Duration(time.Minute)},
+			ExponentialBackoff{Initial: time.Second, Max: time.Minute},
+			false,
+		},
+		{
+			"max delay raised to delay",
+			config.RetryPolicy{Backoff: "decorrelated", Delay: config.Duration(time.Minute), MaxDelay: config.Duration(time.Second)},
+			DecorrelatedJitterBackoff{Base: time.Minute, Max: time.Minute},
+			false,
+		},
+		{"unknown", config.RetryPolicy{Backoff: "linear"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewBackoff(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := b.Next(tt.attempt, 0); got != tt.want {
+			t.Errorf("attempt %d: got %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestDecorrelatedJitterBackoffStaysInBounds(t *testing.T) {
+	b := DecorrelatedJitterBackoff{Base: time.Second, Max: time.Minute}
+	tests := []struct {
+		prev       time.Duration
+		lower, max time.Duration
+	}{
+		{0, time.Second, 3 * time.Second},
+		{2 * time.Second, time.Second, 6 * time.Second},
+		{time.Hour, time.Second, time.Minute},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got := b.Next(i+1, tt.prev)
+			if got < tt.lower || got > tt.max {
+				t.Fatalf("prev %v: got %v, want within [%v, %v]", tt.prev, got, tt.lower, tt.max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusBadRequest}, true},
+		{&StatusError{StatusCode: http.StatusNotFound}, true},
+		{&StatusError{StatusCode: http.StatusUnprocessableEntity}, true},
+		{&StatusError{StatusCode: http.StatusRequestTimeout}, false},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, false},
+		{&StatusError{StatusCode: http.StatusInternalServerError}, false},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, false},
+		{fmt.Errorf("wrapped: %w", &StatusError{StatusCode: http.StatusForbidden}), true},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isPermanent(tt.err); got != tt.want {
+			t.Errorf("isPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNextDelayHonorsRetryAfter(t *testing.T) {
+	destination := &Destination{Backoff: FixedBackoff{Delay: 10 * time.Second}}
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"no status", errors.New("timeout"), 10 * time.Second},
+		{"shorter Retry-After", &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}, 10 * time.Second},
+		{"longer Retry-After", &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Minute}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextDelay(destination, 1, 0, tt.err); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayGivesUp(t *testing.T) {
+	destination := &Destination{
+		Route:       "default",
+		Name:        "default",
+		Backoff:     FixedBackoff{Delay: time.Second},
+		MaxAttempts: 3,
+		MaxElapsed:  time.Minute,
+	}
+	tests := []struct {
+		name      string
+		attempts  int
+		start     time.Time
+		err       error
+		wantRetry bool
+	}{
+		{"transient", 1, time.Now(), errors.New("refused"), true},
+		{"permanent", 1, time.Now(), &StatusError{StatusCode: http.StatusBadRequest}, false},
+		{"out of attempts", 3, time.Now(), errors.New("refused"), false},
+		{"out of time", 1, time.Now().Add(-time.Minute), errors.New("refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retry := retryDelay(destination, tt.attempts, 0, tt.start, tt.err)
+			if retry != tt.wantRetry {
+				t.Fatalf("retry = %v, want %v", retry, tt.wantRetry)
+			}
+			if retry && delay != time.Second {
+				t.Fatalf("delay = %v, want 1s", delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"microservice-1/config"
+)
+
+// bulkItem is the JSON encoding of one message in a bulk request.
+type bulkItem struct {
+	Data           string            `json:"data"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Headers        map[string]string `json:"headers,omitempty"` // Forwarded headers, see RETRY_FORWARD_HEADERS
+	Trace          map[string]string `json:"trace,omitempty"`   // Trace context of the message, e.g. traceparent
+}
+
+// bulkResponse is the body expected from a bulk endpoint: one result per
+// item, in request order.
+type bulkResponse struct {
+	Results []bulkResult `json:"results"`
+}
+
+// bulkResult is the outcome of one item of a bulk request. Status has the
+// meaning of the HTTP status of a single delivery.
+type bulkResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchItem is a message waiting in a batch for its result.
+type batchItem struct {
+	payload bulkItem
+	link    trace.Link // Span of the delivery attempt waiting for the item
+	result  chan error // Buffered, receives exactly one value
+}
+
+// batcher collects messages sent to one destination and POSTs them as a
+// JSON array to its bulk endpoint. A batch is flushed once it holds
+// maxMessages messages or maxBytes payload bytes, or linger after its first
+// message. Every message gets the outcome of its own item, so the retry,
+// dead-lettering and offset commit of each message work as for single
+// deliveries.
+type batcher struct {
+	config      config.BatchConfig // Settings the batcher was created with, see Router.batcher
+	url         string
+	maxMessages int
+	maxBytes    int
+	linger      time.Duration
+	timeout     time.Duration // Timeout of a bulk request; zero means none
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []batchItem
+	bytes   int
+	timer   *time.Timer // Flushes pending after linger; nil while pending is empty
+}
+
+// newBatcher returns a batcher for the bulk endpoint of config. Limits
+// below one message, one byte or one millisecond are raised to that.
+func newBatcher(config config.BatchConfig, timeout time.Duration, client *http.Client) *batcher {
+	b := &batcher{
+		config:      config,
+		url:         config.URL,
+		maxMessages: config.MaxMessages,
+		maxBytes:    config.MaxBytes,
+		linger:      time.Duration(config.Linger),
+		timeout:     timeout,
+		client:      client,
+	}
+	if b.maxMessages < 1 {
+		b.maxMessages = 1
+	}
+	if b.maxBytes < 1 {
+		b.maxBytes = 1
+	}
+	if b.linger < time.Millisecond {
+		b.linger = time.Millisecond
+	}
+	return b
+}
+
+// enqueue adds an item to the current batch without waiting for it to be
+// sent. The returned channel receives the outcome of the item. The span of
+// ctx is linked to the bulk request.
+func (b *batcher) enqueue(ctx context.Context, item bulkItem) <-chan error {
+	result := make(chan error, 1)
+	b.mu.Lock()
+	b.pending = append(b.pending, batchItem{payload: item, link: trace.LinkFromContext(ctx), result: result})
+	b.bytes += len(item.Data)
+	if len(b.pending) >= b.maxMessages || b.bytes >= b.maxBytes {
+		batch := b.take()
+		b.mu.Unlock()
+		go b.post(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.linger, b.flush)
+		}
+		b.mu.Unlock()
+	}
+	return result
+}
+
+// flush posts the pending batch right away. It runs once the linger time
+// has passed, and when a reload replaces or removes the batcher.
+func (b *batcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.post(batch)
+	}
+}
+
+// take removes and returns the pending batch. b.mu must be held.
+func (b *batcher) take() []batchItem {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	b.bytes = 0
+	return batch
+}
+
+// post sends a batch and hands every item its result. The bulk request gets
+// a span of its own, linked to the delivery attempts of its items.
+func (b *batcher) post(batch []batchItem) {
+	links := make([]trace.Link, len(batch))
+	for i, item := range batch {
+		links[i] = item.link
+	}
+	ctx, span := tracer.Start(context.Background(), "deliver batch",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("url.full", b.url),
+			attribute.Int("relay.batch.messages", len(batch)),
+		))
+	defer span.End()
+
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	results := b.do(ctx, batch)
+	for i, item := range batch {
+		item.result <- results[i]
+	}
+}
+
+// do POSTs the batch and returns one error per item, nil for delivered
+// items. A failed request or a malformed response fails every item.
+func (b *batcher) do(ctx context.Context, batch []batchItem) []error {
+	errs := make([]error, len(batch))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	items := make([]bulkItem, len(batch))
+	for i, item := range batch {
+		items[i] = item.payload
+	}
+	jsonData, err := json.Marshal(items)
+	if err != nil {
+		return fail(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if resp.StatusCode != http.StatusOK {
+		return fail(&StatusError{URL: b.url, StatusCode: resp.StatusCode, RetryAfter: retryAfter, Body: readExcerpt(resp.Body)})
+	}
+
+	var body bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fail(fmt.Errorf("invalid bulk response from %s: %w", b.url, err))
+	}
+	if len(body.Results) != len(batch) {
+		return fail(fmt.Errorf("bulk response from %s has %d results for %d messages", b.url, len(body.Results), len(batch)))
+	}
+	for i, result := range body.Results {
+		if result.Status != http.StatusOK {
+			errs[i] = &StatusError{URL: b.url, StatusCode: result.Status, RetryAfter: retryAfter, Detail: result.Error}
+		}
+	}
+	return errs
+}
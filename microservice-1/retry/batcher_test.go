@@ -0,0 +1,167 @@
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"microservice-1/config"
+)
+
+// bulkServer is a bulk endpoint that records the size of every request and
+// answers each item with the status found in its data, e.g. "200".
+type bulkServer struct {
+	*httptest.Server
+	status int // Status of the whole response, 200 if zero
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func newBulkServer(t *testing.T, status int) *bulkServer {
+	s := &bulkServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []bulkItem
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			t.Errorf("invalid bulk request: %v", err)
+		}
+		s.mu.Lock()
+		s.batches = append(s.batches, len(items))
+		s.mu.Unlock()
+
+		if s.status != 0 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(s.status)
+			return
+		}
+		var body bulkResponse
+		for _, item := range items {
+			result := bulkResult{Status: http.StatusOK}
+			json.Unmarshal([]byte(item.Data), &result.Status)
+			body.Results = append(body.Results, result)
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *bulkServer) sizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.batches...)
+}
+
+func TestBatcher(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      config.BatchConfig
+		status      int      // Status of the whole bulk response
+		items       []string // Data of the enqueued items
+		wantBatches []int
+		wantStatus  []int // Status of the error of each item, 0 for success
+	}{
+		{
+			name:        "flushes at max messages",
+			config:      config.BatchConfig{MaxMessages: 2, MaxBytes: 1 << 20, Linger: config.Duration(time.Hour)},
+			items:       []string{"200", "200", "200", "200"},
+			wantBatches: []int{2, 2},
+			wantStatus:  []int{0, 0, 0, 0},
+		},
+		{
+			name:        "flushes at max bytes",
+			config:      config.BatchConfig{MaxMessages: 100, MaxBytes: 6, Linger: config.Duration(time.Hour)},
+			items:       []string{"200", "200", "200", "200"},
+			wantBatches: []int{2, 2},
+			wantStatus:  []int{0, 0, 0, 0},
+		},
+		{
+			name:        "flushes after linger",
+			config:      config.BatchConfig{MaxMessages: 100, MaxBytes: 1 << 20, Linger: config.Duration(10 * time.Millisecond)},
+			items:       []string{"200", "200", "200"},
+			wantBatches: []int{3},
+			wantStatus:  []int{0, 0, 0},
+		},
+		{
+			name:        "results per item",
+			config:      config.BatchConfig{MaxMessages: 3, MaxBytes: 1 << 20, Linger: config.Duration(time.Hour)},
+			items:       []string{"200", "400", "503"},
+			wantBatches: []int{3},
+			wantStatus:  []int{0, 400, 503},
+		},
+		{
+			name:        "failed request fails every item",
+			config:      config.BatchConfig{MaxMessages: 2, MaxBytes: 1 << 20, Linger: config.Duration(time.Hour)},
+			status:      http.StatusServiceUnavailable,
+			items:       []string{"200", "200"},
+			wantBatches: []int{2},
+			wantStatus:  []int{503, 503},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newBulkServer(t, tt.status)
+			tt.config.URL = server.URL
+			b := newBatcher(tt.config, time.Second, server.Client())
+
+			results := make([]<-chan error, len(tt.items))
+			for i, data := range tt.items {
+				results[i] = b.enqueue(context.Background(), bulkItem{Data: data})
+			}
+			for i, result := range results {
+				var err error
+				select {
+				case err = <-result:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("item %d got no result", i)
+				}
+				var status int
+				var statusErr *StatusError
+				if errors.As(err, &statusErr) {
+					status = statusErr.StatusCode
+				} else if err != nil {
+					t.Fatalf("item %d: %v", i, err)
+				}
+				if status != tt.wantStatus[i] {
+					t.Errorf("item %d: status %d, want %d", i, status, tt.wantStatus[i])
+				}
+				if tt.status != 0 && statusErr.RetryAfter != 7*time.Second {
+					t.Errorf("item %d: Retry-After %v, want 7s", i, statusErr.RetryAfter)
+				}
+			}
+			if got := server.sizes(); len(got) != len(tt.wantBatches) {
+				t.Fatalf("batches %v, want %v", got, tt.wantBatches)
+			} else {
+				for i := range got {
+					if got[i] != tt.wantBatches[i] {
+						t.Fatalf("batches %v, want %v", got, tt.wantBatches)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBatcherGrowsBeyondConcurrentSenders(t *testing.T) {
+	// A single sender can fill a batch since enqueue does not wait for the
+	// result
+	server := newBulkServer(t, 0)
+	b := newBatcher(config.BatchConfig{URL: server.URL, MaxMessages: 50, MaxBytes: 1 << 20, Linger: config.Duration(time.Hour)}, time.Second, server.Client())
+	var results []<-chan error
+	for i := 0; i < 50; i++ {
+		results = append(results, b.enqueue(context.Background(), bulkItem{Data: "200"}))
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.sizes(); len(got) != 1 || got[0] != 50 {
+		t.Fatalf("batches %v, want [50]", got)
+	}
+}
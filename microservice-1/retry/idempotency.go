@@ -0,0 +1,50 @@
+package retry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"microservice-1/queue"
+)
+
+// idempotencyKey returns the Idempotency-Key sent with message. With field
+// set it is the value of that top-level JSON field of the message; otherwise,
+// or if the message has no such field, it is the queue.HeaderMessageID set
+// by the memory and file backends, or for Kafka records derived from the
+// topic, partition and offset, which identify the record uniquely. Messages
+// persisted before their Kafka metadata was stored fall back to a hash of
+// the payload.
+func idempotencyKey(message queue.Message, field string) string {
+	if field != "" {
+		var payload map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(message.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err == nil {
+			switch v := payload[field].(type) {
+			case string:
+				if v != "" {
+					return v
+				}
+			case json.Number:
+				return v.String()
+			}
+		}
+	}
+	if id, ok := message.Header(queue.HeaderMessageID); ok && id != "" {
+		return id
+	}
+	if message.Offset < 0 {
+		sum := sha256.Sum256(message.Value)
+		return "sha256-" + hex.EncodeToString(sum[:])
+	}
+	return fmt.Sprintf("%s-%d-%d", message.Topic, message.Partition, message.Offset)
+}
+
+// MessageID returns the id message is recorded under in delivery_attempts,
+// which is its Idempotency-Key.
+func (r *RetryHandler) MessageID(message queue.Message) string {
+	return idempotencyKey(message, r.idempotencyKey)
+}
@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"microservice-1/queue"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	sum := sha256.Sum256([]byte(`{"id":1}`))
+	tests := []struct {
+		name    string
+		message queue.Message
+		field   string
+		want    string
+	}{
+		{
+			name:    "Kafka record",
+			message: queue.Message{Topic: "events", Partition: 1, Offset: 42, Value: []byte(`{"id":1}`)},
+			want:    "events-1-42",
+		},
+		{
+			name:    "string field",
+			message: queue.Message{Topic: "events", Offset: 42, Value: []byte(`{"event_id":"abc"}`)},
+			field:   "event_id",
+			want:    "abc",
+		},
+		{
+			name:    "numeric field keeps its precision",
+			message: queue.Message{Topic: "events", Offset: 42, Value: []byte(`{"event_id":12345678901234567890}`)},
+			field:   "event_id",
+			want:    "12345678901234567890",
+		},
+		{
+			name:    "missing field",
+			message: queue.Message{Topic: "events", Offset: 42, Value: []byte(`{"id":1}`)},
+			field:   "event_id",
+			want:    "events-0-42",
+		},
+		{
+			name:    "empty field",
+			message: queue.Message{Topic: "events", Offset: 42, Value: []byte(`{"event_id":""}`)},
+			field:   "event_id",
+			want:    "events-0-42",
+		},
+		{
+			name: "message ID header",
+			message: queue.Message{Topic: "events", Offset: 0, Value: []byte(`{"id":1}`), Headers: []queue.Header{
+				{Key: queue.HeaderMessageID, Value: []byte("memory-run-0-0")},
+			}},
+			want: "memory-run-0-0",
+		},
+		{
+			name: "field before message ID header",
+			message: queue.Message{Topic: "events", Offset: 0, Value: []byte(`{"event_id":"abc"}`), Headers: []queue.Header{
+				{Key: queue.HeaderMessageID, Value: []byte("memory-run-0-0")},
+			}},
+			field: "event_id",
+			want:  "abc",
+		},
+		{
+			name:    "no Kafka metadata",
+			message: queue.Message{Offset: -1, Value: []byte(`{"id":1}`)},
+			want:    "sha256-" + hex.EncodeToString(sum[:]),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idempotencyKey(tt.message, tt.field); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
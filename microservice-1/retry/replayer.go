@@ -0,0 +1,141 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"microservice-1/breaker"
+	"microservice-1/config"
+	"microservice-1/db"
+	"microservice-1/metrics"
+)
+
+// Replayer periodically drains failed_messages into their targets.
+type Replayer struct {
+	handler   *RetryHandler
+	db        *db.DB
+	interval  time.Duration
+	batchSize int
+	lease     time.Duration
+}
+
+func NewReplayer(config config.RetryConfig, handler *RetryHandler, database *db.DB) *Replayer {
+	return &Replayer{
+		handler:   handler,
+		db:        database,
+		interval:  config.ReplayInterval,
+		batchSize: config.ReplayBatchSize,
+		lease:     config.ReplayLease,
+	}
+}
+
+// Run replays persisted messages every interval until ctx is done.
+func (p *Replayer) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.replayBatch(ctx)
+		}
+	}
+}
+
+// replayBatch claims one batch of persisted messages and sends them, oldest
+// first, see RetryHandler.Replay. After a transient failure the rest of the
+// batch skips that destination since it is most likely still unavailable.
+// Messages that are skipped, or not reached within half the lease, are
+// released for the next cycle or another replica.
+func (p *Replayer) replayBatch(ctx context.Context) {
+	claimed := time.Now()
+	messages, err := p.db.ClaimPendingMessages(p.batchSize, p.lease)
+	if err != nil {
+		log.Printf("Failed to claim failed messages: %v\n", err)
+		return
+	}
+
+	unavailable := make(map[string]bool)
+	for i, msg := range messages {
+		destination := p.handler.router.Route(msg.Message).Destination(msg.Destination)
+		if ctx.Err() != nil || time.Since(claimed) > p.lease/2 {
+			p.release(messages[i:])
+			return
+		}
+		if destination != nil && unavailable[destination.ID()] {
+			p.release(messages[i : i+1])
+			continue
+		}
+		err := p.handler.Replay(ctx, msg)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			p.release(messages[i+1:])
+			return
+		}
+		log.Printf("Replay of failed message %d failed: %v\n", msg.ID, err)
+		if destination != nil && !isPermanent(err) {
+			unavailable[destination.ID()] = true
+		}
+	}
+}
+
+// release ends the claims on messages that were not replayed.
+func (p *Replayer) release(messages []db.FailedMessage) {
+	for _, msg := range messages {
+		if err := p.db.ReleaseFailedMessage(msg.ID); err != nil {
+			log.Printf("Failed to release failed message %d: %v\n", msg.ID, err)
+		}
+	}
+}
+
+// Replay makes one delivery attempt of a persisted message, which the caller
+// must have claimed, to the destination it failed on, within the route it
+// matches now. A delivered message is deleted. Otherwise the attempt is
+// recorded on the message, unless the circuit of the destination was open or
+// ctx was cancelled, and a permanent failure goes to the dead-letter topic.
+// Either way the claim ends.
+func (r *RetryHandler) Replay(ctx context.Context, msg db.FailedMessage) error {
+	route := r.router.Route(msg.Message)
+	destination := route.Destination(msg.Destination)
+	if destination == nil {
+		// The destination was removed from the routes file
+		err := fmt.Errorf("route %s has no destination %q", route.Name, msg.Destination)
+		if recordErr := r.db.RecordFailedAttempt(msg.ID, newAttempt(msg.Attempts+1, err), true); recordErr != nil {
+			log.Printf("Failed to update failed message %d: %v\n", msg.ID, recordErr)
+		}
+		return err
+	}
+
+	err := r.sendAttempt(ctx, destination, msg.Message, msg.Attempts+1)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, breaker.ErrOpen) {
+			if releaseErr := r.db.ReleaseFailedMessage(msg.ID); releaseErr != nil {
+				log.Printf("Failed to release failed message %d: %v\n", msg.ID, releaseErr)
+			}
+			return err
+		}
+		permanent := isPermanent(err)
+		if recordErr := r.db.RecordFailedAttempt(msg.ID, newAttempt(msg.Attempts+1, err), permanent); recordErr != nil {
+			log.Printf("Failed to update failed message %d: %v\n", msg.ID, recordErr)
+		}
+		if permanent {
+			metrics.MessagesPermanentlyFailed.Inc()
+			r.publishDeadLetter(msg.Message, destination.Route, destination.Name, err, msg.Attempts+1)
+		}
+		return err
+	}
+
+	metrics.MessagesDelivered.Inc()
+	if _, err := r.db.DeleteFailedMessage(msg.ID); err != nil {
+		return fmt.Errorf("delivered but failed to delete message %d: %w", msg.ID, err)
+	}
+	log.Printf("Replayed failed message %d\n", msg.ID)
+	return nil
+}
@@ -0,0 +1,67 @@
+package retry
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"microservice-1/config"
+	"microservice-1/db"
+)
+
+// Retention periodically compacts and prunes delivery_attempts.
+type Retention struct {
+	db           *db.DB
+	interval     time.Duration
+	retention    time.Duration // Age at which attempts are deleted; zero keeps them
+	compactAfter time.Duration // Age at which successful first attempts are deleted; zero keeps them
+}
+
+func NewRetention(config config.RetryConfig, database *db.DB) *Retention {
+	return &Retention{
+		db:           database,
+		interval:     config.AttemptsPruneInterval,
+		retention:    config.AttemptsRetention,
+		compactAfter: config.AttemptsCompactAfter,
+	}
+}
+
+// Run prunes delivery_attempts every interval until ctx is done.
+func (p *Retention) Run(ctx context.Context) {
+	if p.retention == 0 && p.compactAfter == 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.prune()
+		}
+	}
+}
+
+// prune deletes the attempts past the retention period and compacts the
+// remaining ones past compactAfter.
+func (p *Retention) prune() {
+	now := time.Now()
+	if p.retention > 0 {
+		deleted, err := p.db.DeleteDeliveryAttempts(now.Add(-p.retention))
+		if err != nil {
+			log.Printf("Failed to delete old delivery attempts: %v\n", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d delivery attempts older than %v\n", deleted, p.retention)
+		}
+	}
+	if p.compactAfter > 0 {
+		compacted, err := p.db.CompactDeliveryAttempts(now.Add(-p.compactAfter))
+		if err != nil {
+			log.Printf("Failed to compact delivery attempts: %v\n", err)
+		} else if compacted > 0 {
+			log.Printf("Compacted %d delivery attempts older than %v\n", compacted, p.compactAfter)
+		}
+	}
+}
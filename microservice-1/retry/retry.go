@@ -2,43 +2,560 @@ package retry
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"microservice-1/breaker"
 	"microservice-1/config"
+	"microservice-1/db"
+	"microservice-1/metrics"
+	"microservice-1/queue"
+	"microservice-1/worker"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
+// excerptBytes bounds the response body kept of a failed delivery.
+const excerptBytes = 1024
+
+// StatusError is returned when a target answers with a non-200 status, or
+// with a non-200 status for one item of a bulk request.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration // Parsed Retry-After header, zero if absent
+	Detail     string        // Error reported for a bulk item, if any
+	Body       string        // Beginning of the response body, see readExcerpt
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("non-200 response from %s: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Permanent reports whether retrying the request cannot succeed. That is the
+// case for every 4xx response except 408 Request Timeout and 429 Too Many
+// Requests.
+func (e *StatusError) Permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+// isPermanent reports whether err is a delivery failure that must not be retried.
+func isPermanent(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Permanent()
+}
+
 type RetryHandler struct {
-	url        string
-	retryDelay time.Duration
+	router         *Router
+	forwardHeaders map[string]string // Kafka header name -> HTTP header name
+	idempotencyKey string            // JSON field used as Idempotency-Key, see idempotencyKey
+	db             *db.DB
+	dlq            *queue.DeadLetterProducer // nil without a dead-letter topic
+	durable        bool                      // Retries wait in retry_jobs instead of in deliver
+
+	inFlight   atomic.Int64   // Deliveries to a destination currently in progress
+	retrying   atomic.Int64   // Of those, deliveries waiting for a retry
+	optional   *worker.Pool   // Deliveries to optional destinations
+	batchSlots chan struct{}  // One per message awaiting a batch result in the background
+	batched    sync.WaitGroup // Messages awaiting a batch result in the background
+
+	laneMu    sync.Mutex
+	laneTails map[string]chan struct{} // Destination ID/lane key -> closed once the last batched delivery started for it has finished
 }
 
-func NewRetryHandler(config config.RetryConfig) *RetryHandler {
+func NewRetryHandler(retryConfig config.RetryConfig, router *Router, database *db.DB, dlq *queue.DeadLetterProducer) (*RetryHandler, error) {
+	var durable bool
+	switch retryConfig.Scheduler {
+	case "", "inline":
+	case "postgres":
+		durable = true
+	default:
+		return nil, fmt.Errorf("unknown retry scheduler %q", retryConfig.Scheduler)
+	}
+	batchSlots := retryConfig.BatchMaxInFlight
+	if batchSlots < 1 {
+		batchSlots = 1
+	}
 	return &RetryHandler{
-		url:        config.TargetURL,
-		retryDelay: config.RetryDelay,
+		router:         router,
+		forwardHeaders: retryConfig.ForwardHeaders,
+		idempotencyKey: retryConfig.IdempotencyKey,
+		db:             database,
+		dlq:            dlq,
+		durable:        durable,
+		optional: worker.NewPool(config.WorkerConfig{
+			PoolSize:   retryConfig.OptionalWorkers,
+			QueueDepth: retryConfig.OptionalQueueDepth,
+		}),
+		batchSlots: make(chan struct{}, batchSlots),
+		laneTails:  make(map[string]chan struct{}),
+	}, nil
+}
+
+// ProcessMessage delivers a message to every destination of its route
+// concurrently, see deliver. A message carrying the HeaderDestination header
+// only goes to the destination of that name. The returned channel receives
+// the outcome once every required destination has handled the message; an
+// error is only reported when a failed message could not be persisted.
+//
+// ProcessMessage itself returns once every required destination without a
+// bulk endpoint has handled the message. Destinations with a bulk endpoint
+// only get the message queued in their current batch, in call order, and
+// their result and any retries are awaited in the background, so that the
+// caller can go on with the next message and batches can grow beyond the
+// number of concurrent callers. A message whose lane key still has a
+// delivery to the same destination outstanding is held back until that
+// delivery has finished, so that a retried message is never overtaken by a
+// later one of the same key. At most RETRY_BATCH_MAX_IN_FLIGHT messages are
+// awaited like that at a time; beyond that ProcessMessage blocks. If no
+// destination has a bulk endpoint the outcome is in the channel by the time
+// ProcessMessage returns.
+//
+// Deliveries to optional destinations are queued on a pool of their own, in
+// order per destination and message lane, and continue in the background,
+// see Wait. While that pool is full ProcessMessage blocks.
+func (r *RetryHandler) ProcessMessage(ctx context.Context, message queue.Message) <-chan error {
+	result := make(chan error, 1)
+	route := r.router.Route(message)
+	destinations := route.Destinations
+	if name, ok := message.Header(queue.HeaderDestination); ok {
+		destination := route.Destination(name)
+		if destination == nil {
+			log.Printf("Route %s has no destination %q, persisting message\n", route.Name, name)
+			result <- r.saveFailed(message, route.Name, name, nil, fmt.Errorf("route %s has no destination %q", route.Name, name), true)
+			return result
+		}
+		destinations = []*Destination{destination}
+	}
+
+	var required, batched sync.WaitGroup
+	var slot bool // Whether the message holds one of r.batchSlots
+	errs := make([]error, len(destinations))
+	for i, destination := range destinations {
+		i, destination := i, destination
+		switch {
+		case destination.Optional:
+			r.optional.Submit(destination.ID()+"/"+message.LaneKey(), func() {
+				if err := r.deliver(ctx, destination, message); err != nil {
+					log.Printf("Failed to deliver message to optional destination %s: %v\n", destination.ID(), err)
+				}
+			})
+		case destination.batch != nil:
+			if !slot {
+				r.batchSlots <- struct{}{}
+				slot = true
+			}
+			batched.Add(1)
+			lane := destination.ID() + "/" + message.LaneKey()
+			previous, done := r.chainBatched(lane)
+			var wait func() error
+			if previous == nil {
+				wait = r.startDelivery(ctx, destination, message)
+			}
+			go func() {
+				defer batched.Done()
+				defer r.finishBatched(lane, done)
+				if wait == nil {
+					<-previous
+					wait = r.startDelivery(ctx, destination, message)
+				}
+				errs[i] = wait()
+			}()
+		default:
+			required.Add(1)
+			go func() {
+				defer required.Done()
+				errs[i] = r.deliver(ctx, destination, message)
+			}()
+		}
+	}
+	required.Wait()
+	if !slot {
+		result <- errors.Join(errs...)
+		return result
 	}
+	r.batched.Add(1)
+	go func() {
+		defer r.batched.Done()
+		batched.Wait()
+		<-r.batchSlots
+		result <- errors.Join(errs...)
+	}()
+	return result
+}
+
+// chainBatched registers a batched delivery on lane, a destination ID and
+// lane key, and returns the channel closed once the previous delivery on
+// lane has finished, or nil if there is none outstanding, together with the
+// channel to pass to finishBatched.
+func (r *RetryHandler) chainBatched(lane string) (previous <-chan struct{}, done chan struct{}) {
+	r.laneMu.Lock()
+	defer r.laneMu.Unlock()
+	done = make(chan struct{})
+	if tail, ok := r.laneTails[lane]; ok {
+		select {
+		case <-tail:
+		default:
+			previous = tail
+		}
+	}
+	r.laneTails[lane] = done
+	return previous, done
+}
+
+// finishBatched marks the batched delivery on lane registered with done as
+// finished, releasing the next one.
+func (r *RetryHandler) finishBatched(lane string, done chan struct{}) {
+	close(done)
+	r.laneMu.Lock()
+	defer r.laneMu.Unlock()
+	if r.laneTails[lane] == done {
+		delete(r.laneTails, lane)
+	}
+}
+
+// Wait blocks until all deliveries to optional destinations and all
+// deliveries awaiting a batch result have finished. ProcessMessage must not
+// be called anymore.
+func (r *RetryHandler) Wait() {
+	r.batched.Wait()
+	r.optional.Close()
 }
 
-func (r *RetryHandler) ProcessMessage(message string) error {
+// deliver delivers a message to one destination, retrying according to its
+// backoff until it succeeds, fails permanently, runs out of attempts or
+// would exceed the maximum elapsed time. With the postgres scheduler only
+// the first attempt is made here and retries are left to the Scheduler. A
+// message that was not delivered is persisted to failed_messages for that
+// destination; an error is only returned when that persistence, or
+// scheduling the retry, fails too. Cancelling ctx aborts the
+// delivery and persists the message right away.
+func (r *RetryHandler) deliver(ctx context.Context, destination *Destination, message queue.Message) error {
+	return r.startDelivery(ctx, destination, message)()
+}
+
+// startDelivery starts the first attempt of deliver, which queues the
+// message in the current batch of a destination with a bulk endpoint, and
+// returns a function that waits for its outcome and does the rest of
+// deliver.
+func (r *RetryHandler) startDelivery(ctx context.Context, destination *Destination, message queue.Message) func() error {
+	r.inFlight.Add(1)
+	metrics.DeliveriesInFlight.Inc()
+	start := time.Now()
+	var first func() error
+	if ctx.Err() == nil {
+		first = r.startAttempt(ctx, destination, message, 1)
+	}
+	return func() error {
+		defer func() {
+			r.inFlight.Add(-1)
+			metrics.DeliveriesInFlight.Dec()
+		}()
+		return r.finishDelivery(ctx, destination, message, start, first)
+	}
+}
+
+// finishDelivery waits for the outcome of the started attempt pending, if
+// any, and makes further attempts as described for deliver. start is the
+// time of the first attempt.
+func (r *RetryHandler) finishDelivery(ctx context.Context, destination *Destination, message queue.Message, start time.Time, pending func() error) error {
+	var delay time.Duration
+	var err error
+	var history []db.Attempt
+	attempts := 0
 	for {
-		err := r.sendToMicroservice2(message)
-		if err != nil {
-			log.Printf("Retrying in %v seconds. Error: %v\n", r.retryDelay.Seconds(), err)
-			time.Sleep(r.retryDelay)
+		// An attempt that was started is always waited for, so that it
+		// releases the circuit breaker
+		if pending == nil {
+			if ctx.Err() != nil {
+				log.Printf("Delivery to %s interrupted after %d attempts, persisting message\n", destination.ID(), attempts)
+				if err == nil {
+					err = fmt.Errorf("delivery interrupted: %w", ctx.Err())
+				}
+				break
+			}
+			pending = r.startAttempt(ctx, destination, message, attempts+1)
+		}
+
+		err = pending()
+		pending = nil
+		if errors.Is(err, breaker.ErrOpen) {
+			// The circuit is open: wait for it to change state instead of
+			// spending an attempt on a request that was never made.
+			destination.Breaker.Wait(ctx)
 			continue
 		}
+		attempts++
+		if err == nil {
+			metrics.MessagesDelivered.Inc()
+			metrics.DeliveryLatency.Observe(time.Since(start).Seconds())
+			metrics.DeliveryAttempts.Observe(float64(attempts))
+			return nil
+		}
+		history = append(history, newAttempt(attempts, err))
+		var retry bool
+		if delay, retry = retryDelay(destination, attempts, delay, start, err); !retry {
+			break
+		}
+		if r.durable {
+			// Hand the retry over to the scheduler so that it survives restarts
+			scheduleErr := r.schedule(message, destination, history, delay)
+			if scheduleErr == nil {
+				return nil
+			}
+			log.Printf("%v, persisting message instead\n", scheduleErr)
+			break
+		}
+		r.retrying.Add(1)
+		sleep(ctx, delay)
+		r.retrying.Add(-1)
+	}
+
+	metrics.DeliveryAttempts.Observe(float64(attempts))
+	return r.saveFailed(message, destination.Route, destination.Name, history, err, isPermanent(err))
+}
+
+// newAttempt describes failed attempt number n for the attempt history.
+func newAttempt(n int, err error) db.Attempt {
+	attempt := db.Attempt{Number: n, At: time.Now(), Error: err.Error()}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		attempt.StatusCode = statusErr.StatusCode
+	}
+	return attempt
+}
+
+// retryDelay decides whether a delivery to destination that failed with err
+// on attempt number attempts is retried, and after which delay. start is the
+// time of the first attempt and prev the delay before the failed attempt.
+func retryDelay(destination *Destination, attempts int, prev time.Duration, start time.Time, err error) (time.Duration, bool) {
+	if isPermanent(err) {
+		log.Printf("Attempt %d to %s failed permanently, not retrying. Error: %v\n", attempts, destination.ID(), err)
+		metrics.MessagesPermanentlyFailed.Inc()
+		return 0, false
+	}
+	if attempts >= destination.MaxAttempts {
+		log.Printf("Giving up on %s after %d attempts. Error: %v\n", destination.ID(), attempts, err)
+		return 0, false
+	}
+
+	delay := nextDelay(destination, attempts, prev, err)
+	if destination.MaxElapsed > 0 && time.Since(start)+delay > destination.MaxElapsed {
+		log.Printf("Giving up on %s after %d attempts, next retry would exceed %v. Error: %v\n", destination.ID(), attempts, destination.MaxElapsed, err)
+		return 0, false
+	}
+	log.Printf("Attempt %d/%d to %s failed, retrying in %v seconds. Error: %v\n", attempts, destination.MaxAttempts, destination.ID(), delay.Seconds(), err)
+	metrics.MessagesRetried.Inc()
+	return delay, true
+}
+
+// schedule stores the next attempt of a delivery in retry_jobs, where the
+// Scheduler picks it up once delay has passed. history holds the attempts
+// made so far and is not empty.
+func (r *RetryHandler) schedule(message queue.Message, destination *Destination, history []db.Attempt, delay time.Duration) error {
+	last := history[len(history)-1]
+	job := db.RetryJob{
+		Message:     message,
+		Route:       destination.Route,
+		Destination: destination.Name,
+		Attempts:    len(history),
+		LastError:   last.Error,
+		Delay:       delay,
+		History:     history,
+	}
+	if err := r.db.EnqueueRetryJob(job); err != nil {
+		return fmt.Errorf("failed to schedule retry after %d attempts (%s): %w", len(history), last.Error, err)
+	}
+	return nil
+}
+
+// saveFailed persists a message that was not delivered to a destination and
+// publishes it to the dead-letter topic if the failure is permanent.
+// history holds the attempts made, if any. A message that cannot be
+// persisted is published to the dead-letter topic instead, so that its
+// offset can still be committed; an error is only returned if that fails
+// too.
+func (r *RetryHandler) saveFailed(message queue.Message, route, destination string, history []db.Attempt, err error, permanent bool) error {
+	attempts := len(history)
+	failed := db.FailedMessage{
+		Message:     message,
+		Route:       route,
+		Destination: destination,
+		Attempts:    attempts,
+		LastError:   err.Error(),
+		Permanent:   permanent,
+		History:     history,
+	}
+	if saveErr := r.db.SaveFailedMessage(failed); saveErr != nil {
+		if dlqErr := r.deadLetter(message, route, destination, err, attempts); dlqErr != nil {
+			return fmt.Errorf("failed to persist message after %d attempts (%v): %w", attempts, err, errors.Join(saveErr, dlqErr))
+		}
+		log.Printf("Failed to persist message, published it to the dead-letter topic instead: %v\n", saveErr)
 		return nil
 	}
+	metrics.MessagesFailedPersisted.Inc()
+	if permanent {
+		r.publishDeadLetter(message, route, destination, err, attempts)
+	}
+	return nil
+}
+
+// dlqTimeout bounds publishing a message to the dead-letter topic.
+const dlqTimeout = 10 * time.Second
+
+// errNoDeadLetterTopic is returned by deadLetter without a dead-letter topic.
+var errNoDeadLetterTopic = errors.New("no dead-letter topic configured")
+
+// publishDeadLetter publishes a permanently failed message to the
+// dead-letter topic, if one is configured. The message is already persisted
+// to failed_messages, so a failure here is only logged.
+func (r *RetryHandler) publishDeadLetter(message queue.Message, route, destination string, reason error, attempts int) {
+	if r.dlq == nil {
+		return
+	}
+	if err := r.deadLetter(message, route, destination, reason, attempts); err != nil {
+		log.Printf("Failed to publish message to dead-letter topic: %v\n", err)
+	}
+}
+
+// deadLetter publishes a message to the dead-letter topic.
+func (r *RetryHandler) deadLetter(message queue.Message, route, destination string, reason error, attempts int) error {
+	if r.dlq == nil {
+		return errNoDeadLetterTopic
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dlqTimeout)
+	defer cancel()
+	if err := r.dlq.Publish(ctx, message, route, destination, reason.Error(), attempts); err != nil {
+		return err
+	}
+	metrics.MessagesDLQPublished.Inc()
+	return nil
+}
+
+// InFlight returns the number of deliveries to a destination in progress.
+func (r *RetryHandler) InFlight() int64 {
+	return r.inFlight.Load()
+}
+
+// Retrying returns the number of in-flight deliveries that failed at least
+// once and are waiting for their next attempt.
+func (r *RetryHandler) Retrying() int64 {
+	return r.retrying.Load()
+}
+
+// Backlog returns the number of deliveries waiting for a retry: those
+// waiting in deliver and, with the postgres scheduler, the jobs in
+// retry_jobs.
+func (r *RetryHandler) Backlog() (int64, error) {
+	backlog := r.retrying.Load()
+	if r.durable {
+		jobs, err := r.db.CountRetryJobs()
+		if err != nil {
+			return 0, err
+		}
+		backlog += int64(jobs)
+	}
+	return backlog, nil
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// nextDelay returns the backoff delay of destination after attempt,
+// stretched to the Retry-After interval requested by it if that is longer.
+func nextDelay(destination *Destination, attempt int, prev time.Duration, err error) time.Duration {
+	delay := destination.Backoff.Next(attempt, prev)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+	return delay
+}
+
+// startSend starts sending a message through the circuit breaker of
+// destination, see startSendToTarget, and returns a function that waits for
+// the outcome. Permanent failures count as successes for the breaker since
+// the target did answer. Requests aborted through ctx are not counted at
+// all; requests that ran into the destination's timeout are failures.
+func (r *RetryHandler) startSend(ctx context.Context, destination *Destination, message queue.Message) func() error {
+	if err := destination.Breaker.Allow(); err != nil {
+		return func() error { return err }
+	}
+	wait := r.startSendToTarget(ctx, destination, message)
+	return func() error {
+		err := wait()
+		switch {
+		case err == nil || isPermanent(err):
+			destination.Breaker.Success()
+		case ctx.Err() != nil:
+			destination.Breaker.Release()
+		default:
+			destination.Breaker.Failure()
+		}
+		return err
+	}
 }
 
-func (r *RetryHandler) sendToMicroservice2(message string) error {
+// startSendToTarget starts delivering a message to destination and returns
+// a function that waits for the outcome or until ctx is done. A destination
+// with a bulk endpoint gets the message added to its current batch right
+// away; otherwise the request is only made by the returned function.
+func (r *RetryHandler) startSendToTarget(ctx context.Context, destination *Destination, message queue.Message) func() error {
+	if destination.batch == nil {
+		return func() error { return r.sendToTarget(ctx, destination, message) }
+	}
+
+	item := bulkItem{
+		Data:           string(message.Value),
+		IdempotencyKey: idempotencyKey(message, r.idempotencyKey),
+		Headers:        r.forwardedHeaders(message),
+		Trace:          make(map[string]string),
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(item.Trace))
+	result := destination.batch.enqueue(ctx, item)
+	return func() error {
+		select {
+		case err := <-result:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendToTarget delivers a message to a destination without a bulk endpoint.
+func (r *RetryHandler) sendToTarget(ctx context.Context, destination *Destination, message queue.Message) error {
+	key := idempotencyKey(message, r.idempotencyKey)
+	if destination.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, destination.Timeout)
+		defer cancel()
+	}
+
 	// Create a map to hold the JSON structure
 	payload := map[string]string{
-		"data": message,
+		"data": string(message.Value),
 	}
 
 	// Marshal the map into a JSON byte slice
@@ -48,14 +565,19 @@ func (r *RetryHandler) sendToMicroservice2(message string) error {
 	}
 
 	// Create a new POST request with the marshaled JSON data
-	req, err := http.NewRequest("POST", r.url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", destination.URL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	for name, value := range r.forwardedHeaders(message) {
+		req.Header.Set(name, value)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	// Send the request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := destination.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -63,9 +585,50 @@ func (r *RetryHandler) sendToMicroservice2(message string) error {
 
 	// Check the response status code
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println(resp)
-		return errors.New("non-200 response from Microservice-2")
+		return &StatusError{
+			URL:        destination.URL,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Body:       readExcerpt(resp.Body),
+		}
 	}
 
 	return nil
 }
+
+// readExcerpt returns the first excerptBytes of a response body for the
+// delivery attempt log.
+func readExcerpt(body io.Reader) string {
+	excerpt, _ := io.ReadAll(io.LimitReader(body, excerptBytes))
+	return string(excerpt)
+}
+
+// forwardedHeaders returns the HTTP headers forwarded from the Kafka headers
+// of message, by HTTP header name.
+func (r *RetryHandler) forwardedHeaders(message queue.Message) map[string]string {
+	headers := make(map[string]string)
+	for kafkaHeader, httpHeader := range r.forwardHeaders {
+		if value, ok := message.Header(kafkaHeader); ok {
+			headers[httpHeader] = value
+		}
+	}
+	return headers
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date. It returns zero for a missing or malformed value.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"microservice-1/config"
+	"microservice-1/db"
+	"microservice-1/queue"
+)
+
+func TestProcessMessageKeepsBatchedKeyOrder(t *testing.T) {
+	var mu sync.Mutex
+	var accepted []string
+	failed := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []bulkItem
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			t.Errorf("invalid bulk request: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var body bulkResponse
+		for _, item := range items {
+			// The first attempt of "a" fails, so it has to be retried.
+			if item.Data == "a" && !failed[item.Data] {
+				failed[item.Data] = true
+				body.Results = append(body.Results, bulkResult{Status: http.StatusServiceUnavailable})
+				continue
+			}
+			accepted = append(accepted, item.Data)
+			body.Results = append(body.Results, bulkResult{Status: http.StatusOK})
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer server.Close()
+
+	retryConfig := testRetryConfig(server.URL)
+	retryConfig.RetryDelay = 10 * time.Millisecond
+	retryConfig.BatchLinger = 20 * time.Millisecond
+	retryConfig.BatchMaxInFlight = 10
+	router, err := NewRouter(retryConfig, config.BreakerConfig{FailureThreshold: 100, SuccessThreshold: 1, ProbeInterval: time.Minute}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recording delivery attempts fails without a database, which is only logged.
+	database := db.NewDB("postgres://127.0.0.1:1/relay?sslmode=disable&connect_timeout=1")
+	defer database.Close()
+	handler, err := NewRetryHandler(retryConfig, router, database, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []<-chan error
+	for _, value := range []string{"a", "b"} {
+		results = append(results, handler.ProcessMessage(context.Background(), queue.Message{Key: []byte("key"), Value: []byte(value)}))
+	}
+	for i, result := range results {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d got no result", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(accepted) != 2 || accepted[0] != "a" || accepted[1] != "b" {
+		t.Fatalf("accepted %v, want [a b]", accepted)
+	}
+}
@@ -0,0 +1,493 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"microservice-1/breaker"
+	"microservice-1/config"
+	"microservice-1/queue"
+)
+
+// Route is an entry of the routing table: the destinations a matching
+// message is delivered to.
+type Route struct {
+	Name         string
+	Destinations []*Destination
+
+	match config.MatchConfig
+}
+
+// Destination is a delivery target together with the retry policy and
+// circuit breaker used for it.
+type Destination struct {
+	Route       string // Name of the route the destination belongs to
+	Name        string // Name within the route; the route name for routes with a single target_url
+	URL         string
+	Timeout     time.Duration // Timeout of a single request; zero means none
+	Backoff     Backoff
+	MaxAttempts int
+	MaxElapsed  time.Duration
+	Optional    bool // Offsets are committed without waiting for this destination
+	Breaker     *breaker.Breaker
+
+	client *http.Client
+	batch  *batcher // nil unless the destination has a bulk endpoint
+}
+
+// ID identifies the destination across routes: "route/destination", or
+// just the route name for routes with a single target_url.
+func (d *Destination) ID() string {
+	if d.Name == d.Route {
+		return d.Route
+	}
+	return d.Route + "/" + d.Name
+}
+
+// Destination returns the destination of the route with the given name, or
+// nil if there is none. An empty name selects the first destination, which
+// is the only one for routes with a single target_url.
+func (r *Route) Destination(name string) *Destination {
+	if name == "" {
+		return r.Destinations[0]
+	}
+	for _, destination := range r.Destinations {
+		if destination.Name == name {
+			return destination
+		}
+	}
+	return nil
+}
+
+// matches reports whether message satisfies every condition of the route.
+// payload is the decoded JSON of the message, nil if it is not an object.
+func (r *Route) matches(message queue.Message, payload map[string]interface{}) bool {
+	if r.match.Topic != "" && r.match.Topic != message.Topic {
+		return false
+	}
+	for name, want := range r.match.Header {
+		if value, ok := message.Header(name); !ok || value != want {
+			return false
+		}
+	}
+	for path, want := range r.match.Field {
+		if value, ok := fieldValue(payload, path); !ok || value != want {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldValue looks up a dot-separated path in a decoded JSON object and
+// returns the value found there as a string. Objects, arrays and null are
+// never matched.
+func fieldValue(payload map[string]interface{}, path string) (string, bool) {
+	var current interface{} = payload
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if current, ok = object[part]; !ok {
+			return "", false
+		}
+	}
+	switch v := current.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// routingTable is one immutable version of the routes file.
+type routingTable struct {
+	routes      []*Route
+	fallback    *Route
+	matchFields bool // Whether any route matches on JSON fields
+}
+
+// Router picks the Route of each message. The routing table is read from
+// RetryConfig.RoutesFile and can be swapped at runtime with Reload; without
+// a routes file every message goes to RetryConfig.TargetURL.
+type Router struct {
+	config        config.RetryConfig
+	breakerConfig config.BreakerConfig
+	client        *http.Client // Used for all destinations
+	table         atomic.Pointer[routingTable]
+
+	mu        sync.Mutex // Guards breakers, batchers, listeners and reloads
+	breakers  map[string]*breaker.Breaker
+	batchers  map[string]*batcher
+	listeners []func(destination string, from, to breaker.State)
+	modTime   time.Time // Modification time of the loaded routes file
+}
+
+// NewRouter loads the routing table. It fails if the routes file cannot be
+// read or declares an invalid route. Deliveries to all destinations use
+// client.
+func NewRouter(config config.RetryConfig, breakerConfig config.BreakerConfig, client *http.Client) (*Router, error) {
+	r := &Router{
+		config:        config,
+		breakerConfig: breakerConfig,
+		client:        client,
+		breakers:      make(map[string]*breaker.Breaker),
+		batchers:      make(map[string]*batcher),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Route returns the first route matching message, or the default route.
+func (r *Router) Route(message queue.Message) *Route {
+	table := r.table.Load()
+
+	var payload map[string]interface{}
+	if table.matchFields {
+		decoder := json.NewDecoder(bytes.NewReader(message.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			payload = nil
+		}
+	}
+
+	for _, route := range table.routes {
+		if route.matches(message, payload) {
+			return route
+		}
+	}
+	return table.fallback
+}
+
+// Routes returns all routes of the current table, the default route last.
+func (r *Router) Routes() []*Route {
+	table := r.table.Load()
+	routes := make([]*Route, 0, len(table.routes)+1)
+	routes = append(routes, table.routes...)
+	return append(routes, table.fallback)
+}
+
+// OnBreakerStateChange registers fn to be called after every state
+// transition of a destination's circuit breaker, including destinations
+// added by later reloads; destination is the ID of the destination.
+// Optional destinations never report opening since they must not hold up
+// anything. When a reload removes a destination whose circuit is not
+// closed, fn is called with a transition to Closed so that nothing waits on
+// it forever.
+func (r *Router) OnBreakerStateChange(fn func(destination string, from, to breaker.State)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, fn)
+	for id, cb := range r.breakers {
+		r.watchBreaker(cb, id, fn)
+	}
+}
+
+// watchBreaker forwards the state changes of the breaker of destination id to fn.
+func (r *Router) watchBreaker(cb *breaker.Breaker, id string, fn func(destination string, from, to breaker.State)) {
+	cb.OnStateChange(func(from, to breaker.State) {
+		if to == breaker.Open && r.optional(id) {
+			return
+		}
+		fn(id, from, to)
+	})
+}
+
+// optional reports whether the destination id is optional in the current table.
+func (r *Router) optional(id string) bool {
+	for _, route := range r.Routes() {
+		for _, destination := range route.Destinations {
+			if destination.ID() == id {
+				return destination.Optional
+			}
+		}
+	}
+	return false
+}
+
+// Batching reports whether a destination of the current table sends its
+// messages to a bulk endpoint.
+func (r *Router) Batching() bool {
+	for _, route := range r.Routes() {
+		for _, destination := range route.Destinations {
+			if destination.batch != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CircuitStates returns the circuit breaker state of every current
+// destination by ID.
+func (r *Router) CircuitStates() map[string]string {
+	states := make(map[string]string)
+	for id, state := range r.BreakerStates() {
+		states[id] = state.String()
+	}
+	return states
+}
+
+// BreakerStates returns the circuit breaker state of every current
+// destination by ID.
+func (r *Router) BreakerStates() map[string]breaker.State {
+	states := make(map[string]breaker.State)
+	for _, route := range r.Routes() {
+		for _, destination := range route.Destinations {
+			states[destination.ID()] = destination.Breaker.State()
+		}
+	}
+	return states
+}
+
+// Reload reads the routes file again and swaps in the new table. On error
+// the current table is kept. Circuit breakers are kept per destination ID
+// across reloads, and so are batchers as long as their settings stay the
+// same; the pending batch of a batcher that is replaced or removed is sent
+// right away.
+func (r *Router) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+// Reconfigure replaces the settings of the default route and the routes
+// file with those of config and reloads the table. On error the previous
+// settings and table are kept. The reload interval cannot be changed, and a
+// routes file set here is only watched if one was set from the start.
+func (r *Router) Reconfigure(config config.RetryConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.config
+	r.config = config
+	if err := r.reload(); err != nil {
+		r.config = previous
+		return err
+	}
+	return nil
+}
+
+// reload does the work of Reload. r.mu must be held.
+func (r *Router) reload() error {
+	var routes config.RoutesConfig
+	if r.config.RoutesFile != "" {
+		info, err := os.Stat(r.config.RoutesFile)
+		if err != nil {
+			return err
+		}
+		if routes, err = config.LoadRoutes(r.config.RoutesFile); err != nil {
+			return err
+		}
+		r.modTime = info.ModTime()
+	}
+
+	defaults := config.RouteConfig{
+		Name:      config.DefaultRouteName,
+		TargetURL: r.config.TargetURL,
+		Timeout:   config.Duration(r.config.Timeout),
+		Retry:     r.config.Policy(),
+		Batch:     r.config.Batch(),
+	}
+	if routes.Default != nil {
+		defaults.Retry = routes.Default.Retry.Inherit(defaults.Retry)
+		defaults.Batch = routes.Default.Batch.Inherit(defaults.Batch)
+		if routes.Default.Batch.URL == "" && routes.Default.TargetURL != "" {
+			defaults.Batch.URL = "" // The default bulk endpoint belongs to RETRY_TARGET_URL
+		}
+		if routes.Default.TargetURL != "" {
+			defaults.TargetURL = routes.Default.TargetURL
+		}
+		if len(routes.Default.Destinations) > 0 {
+			defaults.TargetURL = ""
+			defaults.Batch.URL = ""
+			defaults.Destinations = routes.Default.Destinations
+		}
+		if routes.Default.Timeout != 0 {
+			defaults.Timeout = routes.Default.Timeout
+		}
+	}
+
+	table := &routingTable{}
+	inUse := make(map[string]bool)
+	batchers := make(map[string]*batcher)
+	for _, routeConfig := range routes.Routes {
+		route, err := r.newRoute(routeConfig, defaults, batchers)
+		if err != nil {
+			return err
+		}
+		table.routes = append(table.routes, route)
+		table.matchFields = table.matchFields || len(routeConfig.Match.Field) > 0
+	}
+	fallback, err := r.newRoute(defaults, defaults, batchers)
+	if err != nil {
+		return err
+	}
+	table.fallback = fallback
+	for _, route := range append(table.routes, fallback) {
+		for _, destination := range route.Destinations {
+			inUse[destination.ID()] = true
+		}
+	}
+
+	r.table.Store(table)
+
+	// Send what is left in the batchers that were replaced or removed
+	for id, b := range r.batchers {
+		if batchers[id] != b {
+			go b.flush()
+		}
+	}
+	r.batchers = batchers
+
+	// Forget the breakers of removed destinations
+	for id, cb := range r.breakers {
+		if inUse[id] {
+			continue
+		}
+		delete(r.breakers, id)
+		if state := cb.State(); state != breaker.Closed {
+			for _, fn := range r.listeners {
+				fn(id, state, breaker.Closed)
+			}
+		}
+	}
+
+	log.Printf("Loaded %d routes plus the default route\n", len(table.routes))
+	return nil
+}
+
+// newRoute builds a route, inheriting unset settings from defaults. Its
+// destinations in turn inherit unset settings from the route. The batchers
+// of its destinations are added to batchers by destination ID.
+func (r *Router) newRoute(routeConfig, defaults config.RouteConfig, batchers map[string]*batcher) (*Route, error) {
+	policy := routeConfig.Retry.Inherit(defaults.Retry)
+	batch := routeConfig.Batch.Inherit(defaults.Batch)
+	timeout := routeConfig.Timeout
+	if timeout == 0 {
+		timeout = defaults.Timeout
+	}
+
+	destinations := routeConfig.Destinations
+	if len(destinations) == 0 {
+		destinations = []config.DestinationConfig{{Name: routeConfig.Name, TargetURL: routeConfig.TargetURL, Batch: batch}}
+	}
+
+	route := &Route{Name: routeConfig.Name, match: routeConfig.Match}
+	for _, destinationConfig := range destinations {
+		destinationPolicy := destinationConfig.Retry.Inherit(policy)
+		backoff, err := NewBackoff(destinationPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("route %q, destination %q: %w", routeConfig.Name, destinationConfig.Name, err)
+		}
+		maxAttempts := destinationPolicy.MaxAttempts
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+		destinationTimeout := destinationConfig.Timeout
+		if destinationTimeout == 0 {
+			destinationTimeout = timeout
+		}
+
+		destination := &Destination{
+			Route:       routeConfig.Name,
+			Name:        destinationConfig.Name,
+			URL:         destinationConfig.TargetURL,
+			Timeout:     time.Duration(destinationTimeout),
+			Backoff:     backoff,
+			MaxAttempts: maxAttempts,
+			MaxElapsed:  time.Duration(destinationPolicy.MaxElapsed),
+			Optional:    destinationConfig.Optional,
+			client:      r.client,
+		}
+		destination.Breaker = r.breaker(destination.ID())
+		if destinationBatch := destinationConfig.Batch.Inherit(batch); destinationBatch.URL != "" {
+			destination.batch = r.batcher(destination.ID(), destinationBatch, destination.Timeout)
+			batchers[destination.ID()] = destination.batch
+		}
+		route.Destinations = append(route.Destinations, destination)
+	}
+	return route, nil
+}
+
+// breaker returns the circuit breaker of destination id, creating it on
+// first use. r.mu must be held.
+func (r *Router) breaker(id string) *breaker.Breaker {
+	if cb, ok := r.breakers[id]; ok {
+		return cb
+	}
+	cb := breaker.New(id, r.breakerConfig)
+	for _, fn := range r.listeners {
+		r.watchBreaker(cb, id, fn)
+	}
+	r.breakers[id] = cb
+	return cb
+}
+
+// batcher returns the batcher of destination id if its settings are
+// unchanged, or else a new one. r.mu must be held.
+func (r *Router) batcher(id string, config config.BatchConfig, timeout time.Duration) *batcher {
+	if b, ok := r.batchers[id]; ok && b.config == config && b.timeout == timeout {
+		return b
+	}
+	return newBatcher(config, timeout, r.client)
+}
+
+// Watch reloads the routes file whenever its modification time changes,
+// checking every RoutesReloadInterval until ctx is done. A file that fails
+// to load is logged and the previous table stays in effect.
+func (r *Router) Watch(ctx context.Context) {
+	r.mu.Lock()
+	routesFile, interval := r.config.RoutesFile, r.config.RoutesReloadInterval
+	r.mu.Unlock()
+	if routesFile == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			routesFile = r.config.RoutesFile
+			r.mu.Unlock()
+			if routesFile == "" {
+				continue
+			}
+			info, err := os.Stat(routesFile)
+			if err != nil {
+				log.Printf("Failed to check routes file: %v\n", err)
+				continue
+			}
+			r.mu.Lock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mu.Unlock()
+			if !changed {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("Failed to reload routes, keeping the previous table: %v\n", err)
+				r.mu.Lock()
+				r.modTime = info.ModTime() // Don't retry until the file changes again
+				r.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package retry
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"microservice-1/config"
+)
+
+func testRetryConfig(batchURL string) config.RetryConfig {
+	return config.RetryConfig{
+		TargetURL:        "http://target.invalid/api/data",
+		RetryDelay:       time.Second,
+		Backoff:          "fixed",
+		MaxAttempts:      3,
+		Timeout:          time.Second,
+		BatchURL:         batchURL,
+		BatchMaxMessages: 100,
+		BatchMaxBytes:    1 << 20,
+		BatchLinger:      time.Hour,
+	}
+}
+
+func defaultDestination(r *Router) *Destination {
+	return r.Routes()[0].Destinations[0]
+}
+
+func TestRouterReconfigureKeepsBatchers(t *testing.T) {
+	server := newBulkServer(t, 0)
+	router, err := NewRouter(testRetryConfig(server.URL), config.BreakerConfig{FailureThreshold: 1, SuccessThreshold: 1, ProbeInterval: time.Minute}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := defaultDestination(router)
+	pending := first.batch.enqueue(context.Background(), bulkItem{Data: "200"})
+
+	tests := []struct {
+		name        string
+		change      func(*config.RetryConfig)
+		wantSame    bool // Whether the batcher is kept
+		wantBatch   bool // Whether the destination has a batcher at all
+		wantFlushed bool // Whether the pending item of the previous batcher was sent
+	}{
+		{"unchanged", func(c *config.RetryConfig) {}, true, true, false},
+		{"other retry settings", func(c *config.RetryConfig) { c.MaxAttempts = 5 }, true, true, false},
+		{"other batch size", func(c *config.RetryConfig) { c.BatchMaxMessages = 50 }, false, true, true},
+		{"batching disabled", func(c *config.RetryConfig) { c.BatchURL = "" }, false, false, false},
+	}
+	previous := first
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testRetryConfig(server.URL)
+			tt.change(&c)
+			if err := router.Reconfigure(c); err != nil {
+				t.Fatal(err)
+			}
+			current := defaultDestination(router)
+			if current.Breaker != first.Breaker {
+				t.Fatal("circuit breaker was replaced")
+			}
+			if (current.batch != nil) != tt.wantBatch {
+				t.Fatalf("batcher = %v, want one: %v", current.batch, tt.wantBatch)
+			}
+			if tt.wantBatch && (current.batch == previous.batch) != tt.wantSame {
+				t.Fatalf("batcher kept = %v, want %v", current.batch == previous.batch, tt.wantSame)
+			}
+			if tt.wantFlushed {
+				select {
+				case err := <-pending:
+					if err != nil {
+						t.Fatalf("pending item: %v", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("pending item of the replaced batcher was not sent")
+				}
+			}
+			previous = current
+		})
+	}
+}
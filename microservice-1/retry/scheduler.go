@@ -0,0 +1,137 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"microservice-1/breaker"
+	"microservice-1/config"
+	"microservice-1/db"
+	"microservice-1/metrics"
+)
+
+// Scheduler delivers the retries stored in retry_jobs when RETRY_SCHEDULER
+// is postgres. Its workers claim due jobs with a lease, so any number of
+// replicas can share the jobs and no job is lost when a replica stops.
+type Scheduler struct {
+	handler      *RetryHandler
+	db           *db.DB
+	workers      int
+	pollInterval time.Duration
+	lease        time.Duration
+}
+
+func NewScheduler(config config.RetryConfig, handler *RetryHandler, database *db.DB) *Scheduler {
+	workers := config.SchedulerWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scheduler{
+		handler:      handler,
+		db:           database,
+		workers:      workers,
+		pollInterval: config.SchedulerPollInterval,
+		lease:        config.SchedulerLease,
+	}
+}
+
+// Run delivers due jobs until ctx is done. It returns right away for the
+// inline scheduler.
+func (s *Scheduler) Run(ctx context.Context) {
+	if !s.handler.durable {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// work runs one worker: it handles due jobs back to back and polls for new
+// ones when none is due.
+func (s *Scheduler) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		handled, err := s.handleNext(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to handle retry job: %v\n", err)
+		}
+		if !handled || err != nil {
+			sleep(ctx, s.pollInterval)
+		}
+	}
+}
+
+// handleNext claims one due job and makes its next delivery attempt. It
+// reports whether a job was due.
+func (s *Scheduler) handleNext(ctx context.Context) (bool, error) {
+	job, err := s.db.ClaimRetryJob(ctx, s.lease)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	route := s.handler.router.Route(job.Message)
+	destination := route.Destination(job.Destination)
+	if destination == nil {
+		// The destination was removed from the routes file
+		err := fmt.Errorf("route %s has no destination %q", route.Name, job.Destination)
+		return true, job.Fail(db.FailedMessage{Attempts: job.Attempts, LastError: err.Error(), Permanent: true, History: job.History})
+	}
+
+	s.handler.inFlight.Add(1)
+	metrics.DeliveriesInFlight.Inc()
+	defer func() {
+		s.handler.inFlight.Add(-1)
+		metrics.DeliveriesInFlight.Dec()
+	}()
+
+	err = s.handler.sendAttempt(ctx, destination, job.Message, job.Attempts+1)
+	switch {
+	case err == nil:
+		// Recorded even when shutting down, or the job would be delivered again
+		if err := job.Complete(); err != nil {
+			return true, err
+		}
+		metrics.MessagesDelivered.Inc()
+		metrics.DeliveryLatency.Observe(time.Since(job.CreatedAt).Seconds())
+		metrics.DeliveryAttempts.Observe(float64(job.Attempts + 1))
+		return true, nil
+	case ctx.Err() != nil:
+		// Shutting down: leave the job to the next worker
+		return true, job.Release()
+	case errors.Is(err, breaker.ErrOpen):
+		// Not an attempt; look again once the circuit may have changed
+		return true, job.Reschedule(s.pollInterval, nil)
+	}
+
+	attempts := job.Attempts + 1
+	attempt := newAttempt(attempts, err)
+	if delay, retry := retryDelay(destination, attempts, job.Delay, job.CreatedAt, err); retry {
+		return true, job.Reschedule(delay, &attempt)
+	}
+
+	metrics.DeliveryAttempts.Observe(float64(attempts))
+	permanent := isPermanent(err)
+	failed := db.FailedMessage{
+		Attempts:  attempts,
+		LastError: err.Error(),
+		Permanent: permanent,
+		History:   append(job.History, attempt),
+	}
+	if err := job.Fail(failed); err != nil {
+		return true, err
+	}
+	metrics.MessagesFailedPersisted.Inc()
+	if permanent {
+		s.handler.publishDeadLetter(job.Message, job.Route, job.Destination, err, attempts)
+	}
+	return true, nil
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"microservice-1/config"
+)
+
+// Pool runs jobs on a fixed number of lanes, each served by one goroutine.
+// Jobs submitted with the same key always land on the same lane and
+// therefore run one after another in submission order, while the number of
+// lanes caps the total concurrency.
+type Pool struct {
+	lanes []chan func()
+	wg    sync.WaitGroup
+}
+
+// NewPool starts config.PoolSize lanes, each buffering up to
+// config.QueueDepth jobs.
+func NewPool(config config.WorkerConfig) *Pool {
+	size := config.PoolSize
+	if size < 1 {
+		size = 1
+	}
+	depth := config.QueueDepth
+	if depth < 0 {
+		depth = 0
+	}
+
+	p := &Pool{lanes: make([]chan func(), size)}
+	for i := range p.lanes {
+		lane := make(chan func(), depth)
+		p.lanes[i] = lane
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range lane {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues job on the lane selected by key. It blocks while that lane's
+// queue is full, which in turn slows down whoever is feeding the pool.
+func (p *Pool) Submit(key string, job func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.lanes[h.Sum32()%uint32(len(p.lanes))] <- job
+}
+
+// Close stops accepting jobs and waits for the queued ones to finish.
+func (p *Pool) Close() {
+	for _, lane := range p.lanes {
+		close(lane)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"microservice-1/config"
+)
+
+func TestPoolKeepsOrderPerKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		poolSize int
+		keys     int
+	}{
+		{"single lane", 1, 3},
+		{"fewer lanes than keys", 4, 10},
+		{"more lanes than keys", 16, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool(config.WorkerConfig{PoolSize: tt.poolSize, QueueDepth: 10})
+			var mu sync.Mutex
+			got := make(map[string][]int)
+			for i := 0; i < 50; i++ {
+				for k := 0; k < tt.keys; k++ {
+					key, i := fmt.Sprintf("key-%d", k), i
+					pool.Submit(key, func() {
+						mu.Lock()
+						defer mu.Unlock()
+						got[key] = append(got[key], i)
+					})
+				}
+			}
+			pool.Close()
+
+			for key, seq := range got {
+				if len(seq) != 50 {
+					t.Fatalf("%s: ran %d jobs, want 50", key, len(seq))
+				}
+				for i, n := range seq {
+					if n != i {
+						t.Fatalf("%s: job %d ran at position %d", key, n, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPoolLimitsConcurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		poolSize int
+		want     int64
+	}{
+		{"one lane", 1, 1},
+		{"four lanes", 4, 4},
+		{"size below one", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool(config.WorkerConfig{PoolSize: tt.poolSize, QueueDepth: 100})
+			var running, peak atomic.Int64
+			for i := 0; i < 40; i++ {
+				pool.Submit(fmt.Sprint(i), func() {
+					n := running.Add(1)
+					for {
+						p := peak.Load()
+						if n <= p || peak.CompareAndSwap(p, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					running.Add(-1)
+				})
+			}
+			pool.Close()
+
+			if got := peak.Load(); got > tt.want {
+				t.Fatalf("%d jobs ran concurrently, want at most %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolCloseWaitsForQueuedJobs(t *testing.T) {
+	pool := NewPool(config.WorkerConfig{PoolSize: 2, QueueDepth: 10})
+	var done atomic.Int64
+	for i := 0; i < 10; i++ {
+		pool.Submit(fmt.Sprint(i), func() {
+			time.Sleep(time.Millisecond)
+			done.Add(1)
+		})
+	}
+	pool.Close()
+	if got := done.Load(); got != 10 {
+		t.Fatalf("%d jobs finished before Close returned, want 10", got)
+	}
+}
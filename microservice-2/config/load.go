@@ -0,0 +1,34 @@
+package config
+
+import "shared/layers"
+
+// The configuration is loaded in layers by the shared layers package:
+// defaults(), then the config file, environment variables and command line
+// flags. Fields tagged secret are redacted in dumps and fields tagged
+// reload:"true" can be changed at runtime.
+
+// Loader loads the configuration from its layers, see layers.Loader.
+type Loader = layers.Loader[Config]
+
+// NewLoader parses the command line flags in args, usually os.Args[1:].
+func NewLoader(args []string) (*Loader, error) {
+	return layers.NewLoader(args, defaults)
+}
+
+// Redacted returns the configuration as YAML with secrets replaced.
+func (c Config) Redacted() string {
+	return layers.Redacted(c)
+}
+
+// Changes compares two configurations and returns the environment names of
+// the changed settings that can be applied at runtime and of those that
+// need a restart.
+func Changes(old, new Config) (reloadable, restart []string) {
+	return layers.Changes(old, new)
+}
+
+// Apply returns running with the settings that can be changed at runtime
+// taken from new, i.e. the configuration in effect after a reload.
+func Apply(running, new Config) Config {
+	return layers.Apply(running, new)
+}
@@ -1,10 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"log"
 
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // DB is a wrapper for the SQL connection.
@@ -28,8 +30,36 @@ func NewDB(databaseURL string) *DB {
 	return &DB{Conn: conn}
 }
 
-// InsertMessage inserts a received message into the database.
-func (db *DB) InsertMessage(data string) error {
-	_, err := db.Conn.Exec("INSERT INTO received_messages (data, received_at) VALUES ($1, CURRENT_TIMESTAMP)", data)
-	return err
+// InsertMessage inserts a received message into the database and returns its id.
+func (db *DB) InsertMessage(ctx context.Context, data string) (id int64, err error) {
+	ctx, span := startSpan(ctx, "INSERT", "received_messages")
+	defer func() { endSpan(span, err) }()
+
+	err = db.Conn.QueryRowContext(ctx, "INSERT INTO received_messages (data, received_at) VALUES ($1, CURRENT_TIMESTAMP) RETURNING id", data).Scan(&id)
+	return id, err
+}
+
+// InsertMessageIdempotent inserts a received message unless a message with
+// the same idempotency key was stored before. It returns the id of the
+// stored row and whether it was created by this call.
+func (db *DB) InsertMessageIdempotent(ctx context.Context, data, idempotencyKey string) (id int64, created bool, err error) {
+	ctx, span := startSpan(ctx, "INSERT", "received_messages")
+	defer func() { endSpan(span, err) }()
+
+	err = db.Conn.QueryRowContext(ctx,
+		`INSERT INTO received_messages (data, idempotency_key, received_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+		 ON CONFLICT (idempotency_key) DO NOTHING RETURNING id`,
+		data, idempotencyKey,
+	).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	// The key already exists: return the original row
+	span.SetAttributes(attribute.Bool("relay.duplicate", true))
+	err = db.Conn.QueryRowContext(ctx, "SELECT id FROM received_messages WHERE idempotency_key = $1", idempotencyKey).Scan(&id)
+	return id, false, err
 }
@@ -0,0 +1,17 @@
+package db
+
+import (
+	"embed"
+
+	"shared/migrate"
+)
+
+// migrations holds the schema migrations, see package migrate.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrator returns the migrator of the Microservice-2 schema.
+func (db *DB) Migrator() (*migrate.Migrator, error) {
+	return migrate.New(db.Conn, "microservice-2", migrations, "migrations")
+}
@@ -0,0 +1,12 @@
+-- Messages received from microservice-1. Databases created before
+-- migrations were introduced already have the table, so every step is
+-- idempotent.
+CREATE TABLE IF NOT EXISTS received_messages (
+    id SERIAL PRIMARY KEY,
+    data TEXT NOT NULL,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Deduplicates retried deliveries from microservice-1. NULL for requests
+-- sent without an Idempotency-Key header.
+ALTER TABLE received_messages ADD COLUMN IF NOT EXISTS idempotency_key TEXT UNIQUE;
@@ -1,5 +0,0 @@
-CREATE TABLE IF NOT EXISTS received_messages (
-    id SERIAL PRIMARY KEY,
-    data TEXT NOT NULL,
-    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-);
@@ -1,34 +1,90 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"microservice-2/config"
 	"microservice-2/db"
 	"microservice-2/server"
+	"microservice-2/tracing"
 	"os"
+	"os/signal"
+	"shared/migrate"
+	"strings"
+	"syscall"
 )
 
 func main() {
-	// Load configuration
-	cfg := config.LoadConfig()
+	// Load the configuration from defaults, the config file, the environment
+	// and the command line flags
+	loader, err := config.NewLoader(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", cfg.Redacted())
 
 	// Initialize the database
 	database := db.NewDB(cfg.DatabaseURL)
 	defer database.Conn.Close()
-	// Create the table if not already created
-	sqlFile, err := os.ReadFile("db/schema.sql")
+
+	// Bring the schema up to date, or only run the migrate subcommand
+	migrator, err := database.Migrator()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid migrations: %v", err)
 	}
-	_, err = database.Conn.Exec(string(sqlFile))
-	if err != nil {
-		log.Fatal(err)
+	if args := loader.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := migrate.Run(context.Background(), migrator, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cfg.MigrateOnStart {
+		if err := migrator.Up(context.Background()); err != nil {
+			log.Fatalf("Failed to migrate the database: %v", err)
+		}
 	}
 
-	fmt.Println("Table created successfully!")
+	// Continue the traces of Microservice-1 through the handlers and inserts
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingConfig, "microservice-2")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Start the HTTP server
-	srv := server.NewServer(database)
+	verifier := server.NewVerifier(cfg.SigningKeys, cfg.SignatureMaxAge)
+	go reloadOnHangup(loader, cfg, verifier)
+	srv := server.NewServer(database, verifier)
 	srv.Start(cfg.ServerPort)
 }
+
+// reloadOnHangup loads the configuration again on every SIGHUP and applies
+// the signing keys and maximum signature age. Changes to other settings are
+// logged and take effect on the next restart; running is the configuration
+// in effect, which later reloads are compared to.
+func reloadOnHangup(loader *config.Loader, running config.Config, verifier *server.Verifier) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		cfg, err := loader.Load()
+		if err != nil {
+			log.Printf("Failed to reload configuration, keeping the current one: %v", err)
+			continue
+		}
+		reloadable, restart := config.Changes(running, cfg)
+		if len(restart) > 0 {
+			log.Printf("Changes to %s take effect after a restart", strings.Join(restart, ", "))
+		}
+		running = config.Apply(running, cfg)
+		verifier.SetKeys(running.SigningKeys, running.SignatureMaxAge)
+		if len(reloadable) > 0 {
+			log.Printf("Reloaded configuration, applied changes to %s", strings.Join(reloadable, ", "))
+		} else {
+			log.Println("Reloaded configuration")
+		}
+	}
+}
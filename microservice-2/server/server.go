@@ -1,11 +1,17 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"microservice-2/db"
 	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Payload represents the structure of incoming data.
@@ -13,19 +19,49 @@ type Payload struct {
 	Data string `json:"data"`
 }
 
+// Response is returned for a stored message.
+type Response struct {
+	ID        int64 `json:"id"`
+	Duplicate bool  `json:"duplicate"` // The Idempotency-Key was seen before and no new row was created
+}
+
+// BulkItem is one message of a bulk request.
+type BulkItem struct {
+	Data           string            `json:"data"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Trace          map[string]string `json:"trace,omitempty"` // Trace context of the message, e.g. traceparent
+}
+
+// BulkResult is the outcome of one item of a bulk request. Status is the
+// HTTP status the item would have gotten as a single request.
+type BulkResult struct {
+	Status    int    `json:"status"`
+	ID        int64  `json:"id,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BulkResponse is returned for a bulk request, with one result per item in
+// request order.
+type BulkResponse struct {
+	Results []BulkResult `json:"results"`
+}
+
 // Server holds dependencies for the HTTP server.
 type Server struct {
-	DB *db.DB
+	DB       *db.DB
+	Verifier *Verifier // Checks request signatures; nil accepts unsigned requests
 }
 
 // NewServer initializes a new Server instance.
-func NewServer(db *db.DB) *Server {
-	return &Server{DB: db}
+func NewServer(db *db.DB, verifier *Verifier) *Server {
+	return &Server{DB: db, Verifier: verifier}
 }
 
 // Start runs the HTTP server on the specified port.
 func (s *Server) Start(port string) {
-	http.HandleFunc("/api/data", s.handleData)
+	http.HandleFunc("/api/data", traced("/api/data", s.Verifier.Wrap(s.handleData)))
+	http.HandleFunc("/api/data/bulk", traced("/api/data/bulk", s.Verifier.Wrap(s.handleBulk)))
 
 	// CORS configuration
 	http.HandleFunc("/", s.handleCORS)
@@ -43,7 +79,7 @@ func (s *Server) handleCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 
 	// Allow headers you expect to receive
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Signature, X-Signature-Key-Id, X-Signature-Timestamp, X-Signature-Nonce")
 
 	// Handle preflight requests for OPTIONS method
 	if r.Method == http.MethodOptions {
@@ -73,12 +109,79 @@ func (s *Server) handleData(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Received payload: %v", payload)
 
-	if err := s.DB.InsertMessage(payload.Data); err != nil {
+	// Retried deliveries carry the same Idempotency-Key and must not be stored twice
+	var resp Response
+	var err error
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		var created bool
+		resp.ID, created, err = s.DB.InsertMessageIdempotent(r.Context(), payload.Data, key)
+		resp.Duplicate = !created
+	} else {
+		resp.ID, err = s.DB.InsertMessage(r.Context(), payload.Data)
+	}
+	if err != nil {
 		fmt.Println("DB Error ::", err)
 		http.Error(w, "Failed to save message", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Saved data: %s", payload.Data)
+	if resp.Duplicate {
+		log.Printf("Duplicate delivery, returning stored message %d", resp.ID)
+	} else {
+		log.Printf("Saved data: %s", payload.Data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleBulk handles POST requests carrying a JSON array of messages. Every
+// item is stored on its own, so some items can fail while others succeed;
+// the response reports the outcome of each item.
+func (s *Server) handleBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var items []BulkItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		log.Printf("Error decoding bulk payload: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	resp := BulkResponse{Results: make([]BulkResult, len(items))}
+	for i, item := range items {
+		resp.Results[i] = s.storeBulkItem(r.Context(), item)
+	}
+
+	log.Printf("Stored bulk request of %d messages", len(items))
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// storeBulkItem stores one item of a bulk request. The item continues the
+// trace of the message it carries, linked to the span of the bulk request.
+func (s *Server) storeBulkItem(ctx context.Context, item BulkItem) BulkResult {
+	itemCtx := otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(item.Trace))
+	itemCtx, span := tracer.Start(itemCtx, "store bulk item", trace.WithLinks(trace.LinkFromContext(ctx)))
+	defer span.End()
+
+	result := BulkResult{Status: http.StatusOK}
+	var err error
+	if item.IdempotencyKey != "" {
+		var created bool
+		result.ID, created, err = s.DB.InsertMessageIdempotent(itemCtx, item.Data, item.IdempotencyKey)
+		result.Duplicate = !created
+	} else {
+		result.ID, err = s.DB.InsertMessage(itemCtx, item.Data)
+	}
+	if err != nil {
+		fmt.Println("DB Error ::", err)
+		span.SetStatus(codes.Error, err.Error())
+		return BulkResult{Status: http.StatusInternalServerError, Error: "Failed to save message"}
+	}
+	return result
 }
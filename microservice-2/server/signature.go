@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of a request signed by Microservice-1. The signature is the hex
+// HMAC-SHA256 of "<timestamp>\n<nonce>\n<method>\n<request URI>\n<body>"
+// under the secret of the key id, see signedPrefix.
+const (
+	HeaderSignature          = "X-Signature"
+	HeaderSignatureKeyID     = "X-Signature-Key-Id"
+	HeaderSignatureTimestamp = "X-Signature-Timestamp" // Unix seconds
+	HeaderSignatureNonce     = "X-Signature-Nonce"     // Unique per request
+)
+
+// maxSignedBodySize limits the body read to verify a signature.
+const maxSignedBodySize = 10 << 20
+
+// Verifier checks request signatures. Several keys can be active at once so
+// that secrets can be rotated: add the new key here, switch Microservice-1
+// over, then remove the old key. Keys can be replaced at runtime with
+// SetKeys.
+type Verifier struct {
+	mu     sync.Mutex
+	keys   map[string][]byte // Key id -> secret; empty disables verification
+	maxAge time.Duration
+	nonces map[string]time.Time // Nonces seen within maxAge -> expiry
+	pruned time.Time            // Last time expired nonces were removed
+}
+
+// NewVerifier returns a verifier accepting signatures made with keys. An
+// empty keys disables verification.
+func NewVerifier(keys map[string]string, maxAge time.Duration) *Verifier {
+	v := &Verifier{nonces: make(map[string]time.Time)}
+	v.SetKeys(keys, maxAge)
+	return v
+}
+
+// SetKeys replaces the accepted keys and the maximum signature age.
+// Remembered nonces are kept, so requests seen before cannot be replayed.
+func (v *Verifier) SetKeys(keys map[string]string, maxAge time.Duration) {
+	secrets := make(map[string][]byte, len(keys))
+	for id, secret := range keys {
+		secrets[id] = []byte(secret)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = secrets
+	v.maxAge = maxAge
+}
+
+// enabled reports whether any key is configured.
+func (v *Verifier) enabled() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.keys) > 0
+}
+
+// Wrap returns a handler that rejects requests without a valid signature
+// with 401 before calling next. The signature headers are checked before
+// the body is read, and bodies over maxSignedBodySize are rejected with 413.
+// Without keys, and for a nil verifier, every request is let through.
+func (v *Verifier) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if v == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !v.enabled() {
+			next(w, r)
+			return
+		}
+		now := time.Now()
+		secret, reason := v.checkHeaders(r.Header, now)
+		if reason == "" {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Failed to read request", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			reason = v.checkSignature(r, secret, body, now)
+		}
+		if reason != "" {
+			log.Printf("Rejected request from %s: %s", r.RemoteAddr, reason)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkHeaders checks the signature headers that can be verified without
+// the body, i.e. the key id and the timestamp, and returns the secret of
+// the key id, or why the headers are invalid.
+func (v *Verifier) checkHeaders(header http.Header, now time.Time) ([]byte, string) {
+	v.mu.Lock()
+	secret, ok := v.keys[header.Get(HeaderSignatureKeyID)]
+	maxAge := v.maxAge
+	v.mu.Unlock()
+	if !ok {
+		return nil, "unknown key id"
+	}
+
+	seconds, err := strconv.ParseInt(header.Get(HeaderSignatureTimestamp), 10, 64)
+	if err != nil {
+		return nil, "invalid timestamp"
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > maxAge || age < -maxAge {
+		return nil, "stale timestamp"
+	}
+	if header.Get(HeaderSignatureNonce) == "" {
+		return nil, "missing nonce"
+	}
+	return secret, ""
+}
+
+// checkSignature checks the signature of r, whose headers passed
+// checkHeaders, against secret and body and returns why it is invalid, or
+// "" if it is valid. A valid nonce is remembered so that the same request
+// cannot be replayed.
+func (v *Verifier) checkSignature(r *http.Request, secret, body []byte, now time.Time) string {
+	signature, err := hex.DecodeString(r.Header.Get(HeaderSignature))
+	if err != nil {
+		return "malformed signature"
+	}
+	timestamp := r.Header.Get(HeaderSignatureTimestamp)
+	nonce := r.Header.Get(HeaderSignatureNonce)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signedPrefix(timestamp, nonce, r.Method, r.URL.RequestURI())))
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "signature mismatch"
+	}
+
+	seconds, _ := strconv.ParseInt(timestamp, 10, 64)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.pruned) > time.Second {
+		for seen, expiry := range v.nonces {
+			if now.After(expiry) {
+				delete(v.nonces, seen)
+			}
+		}
+		v.pruned = now
+	}
+	if _, seen := v.nonces[nonce]; seen {
+		return "replayed nonce"
+	}
+	// A timestamp can lie up to maxAge in the future, so the nonce must be
+	// remembered until the timestamp has become stale
+	v.nonces[nonce] = time.Unix(seconds, 0).Add(v.maxAge)
+	return ""
+}
+
+// signedPrefix returns what is signed ahead of the body. Method and request
+// URI are covered so that a signed request cannot be replayed against
+// another endpoint; newlines cannot occur in any of the parts.
+func signedPrefix(timestamp, nonce, method, requestURI string) string {
+	return timestamp + "\n" + nonce + "\n" + method + "\n" + requestURI + "\n"
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request signed like Microservice-1 does.
+func signedRequest(method, target, body, keyID, secret string, at time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signedPrefix(timestamp, nonce, method, r.URL.RequestURI())))
+	mac.Write([]byte(body))
+	r.Header.Set(HeaderSignatureKeyID, keyID)
+	r.Header.Set(HeaderSignatureTimestamp, timestamp)
+	r.Header.Set(HeaderSignatureNonce, nonce)
+	r.Header.Set(HeaderSignature, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// echo answers 200 with the request body.
+func echo(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+}
+
+func TestVerifier(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    int
+	}{
+		{
+			name:    "valid",
+			request: func() *http.Request { return signedRequest("POST", "/api/data", `{"data":"a"}`, "k1", "s1", now, "n1") },
+			want:    http.StatusOK,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest("POST", "/api/data", `{"data":"a"}`, "k1", "s1", now, "n2")
+				r.Body = io.NopCloser(strings.NewReader(`{"data":"b"}`))
+				return r
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "signed for another path",
+			request: func() *http.Request {
+				r := signedRequest("POST", "/api/data", `[]`, "k1", "s1", now, "n3")
+				signed := signedRequest("POST", "/api/data/bulk", `[]`, "k1", "s1", now, "n3")
+				signed.Header = r.Header
+				return signed
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "signed for another method",
+			request: func() *http.Request {
+				r := signedRequest("POST", "/api/data", `{}`, "k1", "s1", now, "n4")
+				r.Method = "PUT"
+				return r
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name:    "wrong secret",
+			request: func() *http.Request { return signedRequest("POST", "/api/data", `{}`, "k1", "other", now, "n5") },
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "unknown key id",
+			request: func() *http.Request { return signedRequest("POST", "/api/data", `{}`, "k3", "s1", now, "n6") },
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "stale timestamp",
+			request: func() *http.Request { return signedRequest("POST", "/api/data", `{}`, "k1", "s1", now.Add(-time.Hour), "n7") },
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "timestamp in the future",
+			request: func() *http.Request { return signedRequest("POST", "/api/data", `{}`, "k1", "s1", now.Add(time.Hour), "n8") },
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "missing nonce",
+			request: func() *http.Request { return signedRequest("POST", "/api/data", `{}`, "k1", "s1", now, "") },
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name: "unsigned",
+			request: func() *http.Request {
+				return httptest.NewRequest("POST", "/api/data", strings.NewReader(`{}`))
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "body too large",
+			request: func() *http.Request {
+				return signedRequest("POST", "/api/data", strings.Repeat("a", maxSignedBodySize+1), "k1", "s1", now, "n9")
+			},
+			want: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	v := NewVerifier(map[string]string{"k1": "s1", "k2": "s2"}, 5*time.Minute)
+	handler := v.Wrap(echo)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, tt.request())
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.want, strings.TrimSpace(w.Body.String()))
+			}
+		})
+	}
+}
+
+func TestVerifierPassesBodyOn(t *testing.T) {
+	v := NewVerifier(map[string]string{"k1": "s1"}, time.Minute)
+	w := httptest.NewRecorder()
+	v.Wrap(echo)(w, signedRequest("POST", "/api/data", `{"data":"a"}`, "k1", "s1", time.Now(), "n1"))
+	if got := w.Body.String(); got != `{"data":"a"}` {
+		t.Fatalf("body = %q", got)
+	}
+}
+
+func TestVerifierRejectsReplayedNonce(t *testing.T) {
+	v := NewVerifier(map[string]string{"k1": "s1"}, time.Minute)
+	handler := v.Wrap(echo)
+	at := time.Now()
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		handler(w, signedRequest("POST", "/api/data", `{}`, "k1", "s1", at, "same"))
+		if w.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, want)
+		}
+	}
+
+	// Rotating keys must not make a seen nonce acceptable again
+	v.SetKeys(map[string]string{"k1": "s1", "k2": "s2"}, time.Minute)
+	w := httptest.NewRecorder()
+	handler(w, signedRequest("POST", "/api/data", `{}`, "k2", "s2", at, "same"))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("after SetKeys: status = %d, want 401", w.Code)
+	}
+}
+
+func TestVerifierKeyRotation(t *testing.T) {
+	v := NewVerifier(map[string]string{"old": "s1"}, time.Minute)
+	handler := v.Wrap(echo)
+	steps := []struct {
+		name  string
+		keys  map[string]string
+		oldOK bool
+		newOK bool
+	}{
+		{"before", map[string]string{"old": "s1"}, true, false},
+		{"both active", map[string]string{"old": "s1", "new": "s2"}, true, true},
+		{"old removed", map[string]string{"new": "s2"}, false, true},
+	}
+	for i, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			v.SetKeys(step.keys, time.Minute)
+			for _, c := range []struct {
+				keyID, secret string
+				ok            bool
+			}{{"old", "s1", step.oldOK}, {"new", "s2", step.newOK}} {
+				w := httptest.NewRecorder()
+				handler(w, signedRequest("POST", "/api/data", `{}`, c.keyID, c.secret, time.Now(), c.keyID+strconv.Itoa(i)))
+				if got := w.Code == http.StatusOK; got != c.ok {
+					t.Errorf("key %s accepted = %v, want %v", c.keyID, got, c.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifierDisabledWithoutKeys(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewVerifier(nil, time.Minute).Wrap(echo)(w, httptest.NewRequest("POST", "/api/data", strings.NewReader(`{}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,17 @@
+package db
+
+import (
+	"embed"
+
+	"shared/migrate"
+)
+
+// migrations holds the schema migrations, see package migrate.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrator returns the migrator of the SIM data processor schema.
+func (db *DBHandler) Migrator() (*migrate.Migrator, error) {
+	return migrate.New(db.Conn, "problem-2", migrations, "migrations")
+}
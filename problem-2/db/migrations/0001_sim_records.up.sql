@@ -1,3 +1,5 @@
+-- Validated SIM records. Databases created before migrations were
+-- introduced already have the table, so the step is idempotent.
 CREATE TABLE IF NOT EXISTS sim_records (
     id SERIAL PRIMARY KEY,
     imsi BIGINT NOT NULL UNIQUE,
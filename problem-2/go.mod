@@ -2,4 +2,11 @@ module problem-2
 
 go 1.23.3
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/lib/pq v1.10.9
+	shared v0.0.0
+)
+
+require gopkg.in/yaml.v3 v3.0.1 // indirect
+
+replace shared => ../shared
@@ -1,25 +1,67 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"problem-2/config"
+	"problem-2/db"
 	"problem-2/fileprocessor"
+	"shared/migrate"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	// Load configuration
-	cfg := config.LoadConfig()
+	// Load configuration from defaults, the config file, the environment and
+	// the command line flags
+	loader, err := config.NewLoader(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", cfg.Redacted())
+
+	// Initialize the DB handler
+	cfg.DBHandler, err = db.NewDBHandler(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to initialize database handler: %v", err)
+	}
+
+	// Bring the schema up to date, or only run the migrate subcommand
+	migrator, err := cfg.DBHandler.Migrator()
+	if err != nil {
+		log.Fatalf("Invalid migrations: %v", err)
+	}
+	if args := loader.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := migrate.Run(context.Background(), migrator, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cfg.MigrateOnStart {
+		if err := migrator.Up(context.Background()); err != nil {
+			log.Fatalf("Failed to migrate the database: %v", err)
+		}
+	}
+
 	var FileProcessedMap = make(map[string]struct{})
 	log.Println("Starting SIM Data Processor...")
 
+	// Reload the folders and the scan interval on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
 	// Periodic folder scanning
 	for {
 		files, err := fileprocessor.ScanFolder(cfg.InputFolder)
 		if err != nil {
 			log.Printf("Error scanning folder: %v\n", err)
-			continue
 		}
 
 		for _, file := range files {
@@ -36,6 +78,32 @@ func main() {
 			FileProcessedMap[file] = struct{}{}
 		}
 
-		time.Sleep(cfg.ScanInterval)
+		select {
+		case <-time.After(cfg.ScanInterval):
+		case <-hangup:
+			cfg = reload(loader, cfg)
+		}
+	}
+}
+
+// reload loads the configuration again and returns running, the
+// configuration in effect, with the settings that can change at runtime
+// replaced. Changes to other settings are logged and take effect on the
+// next restart.
+func reload(loader *config.Loader, running config.Config) config.Config {
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Printf("Failed to reload configuration, keeping the current one: %v\n", err)
+		return running
+	}
+	reloadable, restart := config.Changes(running, cfg)
+	if len(restart) > 0 {
+		log.Printf("Changes to %s take effect after a restart\n", strings.Join(restart, ", "))
+	}
+	if len(reloadable) > 0 {
+		log.Printf("Reloaded configuration, applied changes to %s\n", strings.Join(reloadable, ", "))
+	} else {
+		log.Println("Reloaded configuration")
 	}
+	return config.Apply(running, cfg)
 }
@@ -0,0 +1,341 @@
+// Package layers loads the configuration of a service from its layers.
+package layers
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration is built in layers, each overriding the one before:
+//
+//  1. the defaults of the service
+//  2. the YAML or JSON file given by -config or CONFIG_FILE
+//  3. environment variables; NAME_FILE reads the value of NAME from a file,
+//     e.g. a Docker secret
+//  4. command line flags, named after the environment variables
+//
+// Settings are the fields of the configuration struct tagged with env, e.g.
+// QUEUE_BROKER is queue.broker in the file and -queue-broker on the command
+// line. Fields tagged secret:"true" are redacted in dumps; secret:"url" only
+// redacts the password of a URL. Fields tagged reload:"true" can be changed
+// at runtime, see Changes and Apply.
+
+// Config is implemented by the configuration struct of a service.
+type Config interface {
+	Validate() error
+}
+
+// Loader loads a configuration of type T from its layers. It remembers the
+// config file and flags so that Load can be called again on SIGHUP.
+type Loader[T Config] struct {
+	defaults func() T
+	file     string
+	flags    map[string]string // Env name -> value given on the command line
+	args     []string          // Arguments after the flags
+}
+
+// NewLoader parses the command line flags in args, usually os.Args[1:].
+// defaults returns the configuration used where no layer sets a value.
+func NewLoader[T Config](args []string, defaults func() T) (*Loader[T], error) {
+	l := &Loader[T]{defaults: defaults, file: os.Getenv("CONFIG_FILE"), flags: make(map[string]string)}
+	set := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	set.StringVar(&l.file, "config", l.file, "YAML or JSON config file")
+	cfg := defaults()
+	for _, s := range settings(&cfg) {
+		env := s.env
+		isBool := s.value.Kind() == reflect.Bool
+		set.Var(&flagValue{isBool: isBool, set: func(v string) { l.flags[env] = v }}, s.flag(), "overrides "+env)
+	}
+	if err := set.Parse(args); err != nil {
+		return nil, err
+	}
+	l.args = set.Args()
+	return l, nil
+}
+
+// Args returns the command line arguments after the flags.
+func (l *Loader[T]) Args() []string {
+	return l.args
+}
+
+// Load builds and validates the configuration.
+func (l *Loader[T]) Load() (T, error) {
+	var zero T
+	cfg := l.defaults()
+	if l.file != "" {
+		data, err := os.ReadFile(l.file)
+		if err != nil {
+			return zero, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return zero, fmt.Errorf("invalid config file %s: %w", l.file, err)
+		}
+	}
+
+	var errs []error
+	for _, s := range settings(&cfg) {
+		value, ok, err := lookupEnv(s.env)
+		if flagValue, set := l.flags[s.env]; set {
+			value, ok, err = flagValue, true, nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := parseValue(s.value, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return zero, errors.Join(errs...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return zero, err
+	}
+	return cfg, nil
+}
+
+// lookupEnv returns the value of the environment variable name, or the
+// contents of the file named by name_FILE.
+func lookupEnv(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// Redacted returns cfg as YAML with secrets replaced.
+func Redacted[T any](cfg T) string {
+	for _, s := range settings(&cfg) {
+		if s.secret != "" {
+			redact(s.value, s.secret)
+		}
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// redact replaces a secret value in place. A value that is not a URL with
+// a scheme and a host, e.g. a key=value connection string, is redacted
+// entirely even in url mode, since url.Parse accepts it without finding its
+// password.
+func redact(v reflect.Value, mode string) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.String() == "" {
+			return
+		}
+		if mode == "url" {
+			if u, err := url.Parse(v.String()); err == nil && u.Scheme != "" && u.Host != "" {
+				v.SetString(u.Redacted())
+				return
+			}
+		}
+		v.SetString("REDACTED")
+	case reflect.Map:
+		redacted := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			redacted.SetMapIndex(key, reflect.ValueOf("REDACTED"))
+		}
+		v.Set(redacted)
+	}
+}
+
+// Changes compares two configurations and returns the environment names of
+// the changed settings that can be applied at runtime and of those that
+// need a restart.
+func Changes[T any](old, new T) (reloadable, restart []string) {
+	oldSettings := settings(&old)
+	for i, s := range settings(&new) {
+		if reflect.DeepEqual(oldSettings[i].value.Interface(), s.value.Interface()) {
+			continue
+		}
+		if s.reload {
+			reloadable = append(reloadable, s.env)
+		} else {
+			restart = append(restart, s.env)
+		}
+	}
+	return reloadable, restart
+}
+
+// Apply returns running with the settings that can be changed at runtime
+// taken from new. The result is the configuration in effect after a reload;
+// the other settings keep their running values until a restart.
+func Apply[T any](running, new T) T {
+	newSettings := settings(&new)
+	for i, s := range settings(&running) {
+		if s.reload {
+			s.value.Set(newSettings[i].value)
+		}
+	}
+	return running
+}
+
+// Validator collects validation errors.
+type Validator struct {
+	errs []error
+}
+
+// Check records an error for the setting env unless ok.
+func (v *Validator) Check(ok bool, env, format string, args ...interface{}) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf("%s: %s", env, fmt.Sprintf(format, args...)))
+	}
+}
+
+// CheckURL records an error unless value is empty or an absolute HTTP(S) URL.
+func (v *Validator) CheckURL(value, env string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", env, "must be an http or https URL")
+}
+
+// CheckOneOf records an error unless value is one of allowed.
+func (v *Validator) CheckOneOf(value, env string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.Check(false, env, "must be one of %s", strings.Join(allowed, ", "))
+}
+
+// Err returns the recorded errors joined, or nil if there are none.
+func (v *Validator) Err() error {
+	return errors.Join(v.errs...)
+}
+
+// setting is a field of a configuration struct tagged with env.
+type setting struct {
+	env    string
+	path   string // Dotted key in the config file
+	secret string
+	reload bool
+	value  reflect.Value
+}
+
+func (s setting) name() string {
+	return s.env + " (" + s.path + ")"
+}
+
+func (s setting) flag() string {
+	return strings.ToLower(strings.ReplaceAll(s.env, "_", "-"))
+}
+
+// settings returns the settings of the struct cfg points to in declaration
+// order.
+func settings(cfg interface{}) []setting {
+	var result []setting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if key == "" || key == "-" {
+				continue
+			}
+			if env := field.Tag.Get("env"); env != "" {
+				result = append(result, setting{
+					env:    env,
+					path:   prefix + key,
+					secret: field.Tag.Get("secret"),
+					reload: field.Tag.Get("reload") == "true",
+					value:  v.Field(i),
+				})
+			} else if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), prefix+key+".")
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return result
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// parseValue parses s into v. Maps are written as "a:b,c:d"; an entry
+// without a colon maps a name to itself.
+func parseValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String && v.Type().Elem().Kind() == reflect.String:
+		m := make(map[string]string)
+		for _, entry := range strings.Split(s, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			from, to, found := strings.Cut(entry, ":")
+			if !found {
+				to = from
+			}
+			m[strings.TrimSpace(from)] = strings.TrimSpace(to)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue records a flag given on the command line.
+type flagValue struct {
+	isBool bool
+	set    func(string)
+}
+
+func (f *flagValue) String() string   { return "" }
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+func (f *flagValue) Set(v string) error {
+	f.set(v)
+	return nil
+}
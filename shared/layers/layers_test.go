@@ -0,0 +1,248 @@
+package layers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name  string            `yaml:"name" env:"TEST_NAME"`
+	DSN   string            `yaml:"dsn" env:"TEST_DSN" secret:"url"`
+	Token string            `yaml:"token" env:"TEST_TOKEN" secret:"true"`
+	Keys  map[string]string `yaml:"keys" env:"TEST_KEYS" secret:"true" reload:"true"`
+	Inner testInner         `yaml:"inner"`
+	Skip  *int              `yaml:"-"`
+}
+
+type testInner struct {
+	Interval time.Duration `yaml:"interval" env:"TEST_INTERVAL" reload:"true"`
+	Count    int           `yaml:"count" env:"TEST_COUNT"`
+	Enabled  bool          `yaml:"enabled" env:"TEST_ENABLED"`
+}
+
+func (c testConfig) Validate() error {
+	var v Validator
+	v.Check(c.Inner.Count >= 0, "TEST_COUNT", "must not be negative")
+	return v.Err()
+}
+
+func testDefaults() testConfig {
+	return testConfig{Name: "default", Inner: testInner{Interval: time.Second, Count: 1}}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	file := writeFile("config.yaml", "name: file\ninner:\n  interval: 5s\n  count: 2\n")
+	unknown := writeFile("unknown.yaml", "name: file\nnmae: typo\n")
+	secret := writeFile("token", "from-file\n")
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		want     func(*testConfig)
+		wantArgs []string
+		wantErr  string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "file overrides defaults",
+			args: []string{"-config", file},
+			want: func(c *testConfig) { c.Name = "file"; c.Inner.Interval = 5 * time.Second; c.Inner.Count = 2 },
+		},
+		{
+			name: "environment overrides file",
+			args: []string{"-config", file},
+			env:  map[string]string{"TEST_NAME": "env", "TEST_ENABLED": "true"},
+			want: func(c *testConfig) {
+				c.Name = "env"
+				c.Inner.Interval = 5 * time.Second
+				c.Inner.Count = 2
+				c.Inner.Enabled = true
+			},
+		},
+		{
+			name:     "flags override environment",
+			args:     []string{"-test-name", "flag", "-test-enabled", "serve"},
+			env:      map[string]string{"TEST_NAME": "env"},
+			want:     func(c *testConfig) { c.Name = "flag"; c.Inner.Enabled = true },
+			wantArgs: []string{"serve"},
+		},
+		{
+			name: "value read from file",
+			env:  map[string]string{"TEST_TOKEN_FILE": secret},
+			want: func(c *testConfig) { c.Token = "from-file" },
+		},
+		{
+			name: "map",
+			env:  map[string]string{"TEST_KEYS": "a:1, b ,"},
+			want: func(c *testConfig) { c.Keys = map[string]string{"a": "1", "b": "b"} },
+		},
+		{
+			name:    "unknown key in file",
+			args:    []string{"-config", unknown},
+			wantErr: "invalid config file",
+		},
+		{
+			name:    "invalid value",
+			env:     map[string]string{"TEST_INTERVAL": "soon"},
+			wantErr: `TEST_INTERVAL (inner.interval): invalid duration "soon"`,
+		},
+		{
+			name:    "missing value file",
+			env:     map[string]string{"TEST_TOKEN_FILE": filepath.Join(dir, "missing")},
+			wantErr: "TEST_TOKEN_FILE",
+		},
+		{
+			name:    "invalid setting",
+			env:     map[string]string{"TEST_COUNT": "-1"},
+			wantErr: "TEST_COUNT: must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			loader, err := NewLoader(tt.args, testDefaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := loader.Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testDefaults()
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("Load() = %+v, want %+v", got, want)
+			}
+			if strings.Join(loader.Args(), " ") != strings.Join(tt.wantArgs, " ") {
+				t.Fatalf("Args() = %q, want %q", loader.Args(), tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		want    string
+		notWant string
+	}{
+		{"url", "postgres://user:pw@db:5432/app?sslmode=disable", "dsn: postgres://user:xxxxx@db:5432/app?sslmode=disable", "pw@"},
+		{"url without password", "postgres://db:5432/app", "dsn: postgres://db:5432/app", ""},
+		{"key=value", "host=db user=user password=pw dbname=app", "dsn: REDACTED", "pw"},
+		{"no scheme", "user:pw@db/app", "dsn: REDACTED", "pw"},
+		{"empty", "", `dsn: ""`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig{DSN: tt.dsn, Token: "t0ken", Keys: map[string]string{"k1": "s3cret"}}
+			got := Redacted(cfg)
+			if !strings.Contains(got, tt.want) {
+				t.Fatalf("Redacted() = %q, want it to contain %q", got, tt.want)
+			}
+			for _, secret := range []string{tt.notWant, "t0ken", "s3cret"} {
+				if secret != "" && strings.Contains(got, secret) {
+					t.Fatalf("Redacted() = %q, contains %q", got, secret)
+				}
+			}
+			if !strings.Contains(got, "k1: REDACTED") {
+				t.Fatalf("Redacted() = %q, want the key of the map kept", got)
+			}
+			if cfg.Keys["k1"] != "s3cret" {
+				t.Fatalf("Redacted() modified the configuration: %v", cfg.Keys)
+			}
+		})
+	}
+}
+
+func TestChangesAndApply(t *testing.T) {
+	running := testDefaults()
+	running.Keys = map[string]string{"k1": "s1"}
+	reloaded := running
+	reloaded.Name = "renamed"
+	reloaded.Inner.Interval = time.Minute
+	reloaded.Keys = map[string]string{"k2": "s2"}
+
+	reloadable, restart := Changes(running, reloaded)
+	if want := []string{"TEST_KEYS", "TEST_INTERVAL"}; !reflect.DeepEqual(reloadable, want) {
+		t.Fatalf("reloadable = %q, want %q", reloadable, want)
+	}
+	if want := []string{"TEST_NAME"}; !reflect.DeepEqual(restart, want) {
+		t.Fatalf("restart = %q, want %q", restart, want)
+	}
+
+	applied := Apply(running, reloaded)
+	want := running
+	want.Inner.Interval = time.Minute
+	want.Keys = map[string]string{"k2": "s2"}
+	if !reflect.DeepEqual(applied, want) {
+		t.Fatalf("Apply() = %+v, want %+v", applied, want)
+	}
+	if running.Inner.Interval != time.Second {
+		t.Fatalf("Apply() modified running: %+v", running)
+	}
+
+	// Compared to the applied configuration, only the restart setting is
+	// still pending
+	reloadable, restart = Changes(applied, reloaded)
+	if len(reloadable) != 0 || !reflect.DeepEqual(restart, []string{"TEST_NAME"}) {
+		t.Fatalf("Changes(applied) = %q, %q, want only TEST_NAME pending", reloadable, restart)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(*Validator)
+		want  string
+	}{
+		{"check ok", func(v *Validator) { v.Check(true, "A", "fails") }, ""},
+		{"check failed", func(v *Validator) { v.Check(false, "A", "must be %d", 1) }, "A: must be 1"},
+		{"empty url", func(v *Validator) { v.CheckURL("", "U") }, ""},
+		{"http url", func(v *Validator) { v.CheckURL("https://example.com/path", "U") }, ""},
+		{"other scheme", func(v *Validator) { v.CheckURL("ftp://example.com", "U") }, "U: must be an http or https URL"},
+		{"relative url", func(v *Validator) { v.CheckURL("/path", "U") }, "U: must be an http or https URL"},
+		{"one of", func(v *Validator) { v.CheckOneOf("b", "O", "a", "b") }, ""},
+		{"not one of", func(v *Validator) { v.CheckOneOf("c", "O", "a", "b") }, "O: must be one of a, b"},
+		{"several", func(v *Validator) { v.Check(false, "A", "x"); v.Check(false, "B", "y") }, "A: x\nB: y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v Validator
+			tt.check(&v)
+			got := ""
+			if err := v.Err(); err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Fatalf("Err() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
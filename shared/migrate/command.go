@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Usage describes the arguments of the migrate subcommand.
+const Usage = `usage: migrate [command]
+
+commands:
+  up          apply all pending migrations (default)
+  down [n]    revert the last n applied migrations (default 1)
+  to <v>      apply or revert migrations until version v is the latest applied
+  status      list the migrations and when they were applied`
+
+// Run executes the migrate subcommand with args, the arguments after
+// "migrate".
+func Run(ctx context.Context, m *Migrator, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch {
+	case command == "up" && len(args) == 0:
+		return m.Up(ctx)
+	case command == "down" && len(args) <= 1:
+		steps := 1
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q\n%s", args[0], Usage)
+			}
+			steps = n
+		}
+		return m.Down(ctx, steps)
+	case command == "to" && len(args) == 1:
+		version, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q\n%s", args[0], Usage)
+		}
+		return m.To(ctx, version)
+	case command == "status" && len(args) == 0:
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-32s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid arguments\n%s", Usage)
+}
@@ -0,0 +1,319 @@
+// Package migrate applies the versioned schema migrations of a service.
+//
+// Migrations are SQL files named <version>_<name>.up.sql, with an optional
+// <version>_<name>.down.sql that reverts them. A migration without a down
+// file cannot be reverted, e.g. one that adopts tables created before
+// migrations were introduced, whose down file would drop data that predates
+// it. Versions are positive integers applied in ascending order; every
+// migration runs in its own transaction together with its row in
+// schema_migrations. Since the services share one database,
+// schema_migrations records the service name next to the version.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string // Empty if the migration cannot be reverted
+}
+
+// Status describes a migration and whether it has been applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time // nil if pending
+}
+
+// Migrator applies the migrations of one service to a database.
+type Migrator struct {
+	conn       *sql.DB
+	service    string
+	migrations []Migration // Ascending by version
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-zA-Z0-9_]+)\.(up|down)\.sql$`)
+
+// New reads the migrations in the directory dir of files, usually an
+// embed.FS, for service.
+func New(conn *sql.DB, service string, files fs.FS, dir string) (*Migrator, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.Name, match[2], version)
+		}
+		content, err := fs.ReadFile(files, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrator := &Migrator{conn: conn, service: service}
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrator.migrations = append(migrator.migrations, *m)
+	}
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].Version < migrator.migrations[j].Version
+	})
+	return migrator, nil
+}
+
+// Latest returns the version of the newest migration, or zero if there is
+// none.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the last steps applied migrations. Nothing is reverted if
+// one of them cannot be.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		var reverts []Migration
+		for i := len(m.migrations) - 1; i >= 0 && len(reverts) < steps; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				reverts = append(reverts, m.migrations[i])
+			}
+		}
+		return m.revertAll(ctx, conn, reverts)
+	})
+}
+
+// To applies or reverts migrations until exactly those up to version are
+// applied. Version zero reverts all of them. Nothing is reverted if one of
+// the migrations above version cannot be.
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+	return m.withLock(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		var reverts []Migration
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				reverts = append(reverts, migration)
+			}
+		}
+		if err := m.revertAll(ctx, conn, reverts); err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.apply(ctx, conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status returns every known migration with the time it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if at, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// createTable creates schema_migrations unless it exists, holding a
+// transaction-scoped lock shared by all services.
+func createTable(ctx context.Context, conn *sql.Conn) error {
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))"); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx,
+			`CREATE TABLE IF NOT EXISTS schema_migrations (
+			    service TEXT NOT NULL,
+			    version BIGINT NOT NULL,
+			    name TEXT NOT NULL,
+			    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			    PRIMARY KEY (service, version)
+			)`)
+		return err
+	})
+}
+
+// withLock runs fn on a connection holding the migration lock of the
+// service, so that replicas starting at the same time do not apply a
+// migration twice. fn gets the versions applied so far.
+//
+// The migration lock is per service, but schema_migrations is shared, so it
+// is created under a lock of its own: concurrent CREATE TABLE IF NOT EXISTS
+// statements can fail on the unique index of pg_type.
+func (m *Migrator) withLock(ctx context.Context, fn func(*sql.Conn, map[int64]time.Time) error) error {
+	// Advisory locks belong to a session, so everything runs on one connection
+	conn, err := m.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockKey := "schema_migrations:" + m.service
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", lockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer func() {
+		// Use a fresh context so the lock is released even if ctx is done
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockKey); err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}()
+
+	if err := createTable(ctx, conn); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations WHERE service = $1", m.service)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for version := range applied {
+		if m.find(version) == nil {
+			return fmt.Errorf("database has migration %d of %s applied, which is newer than this build", version, m.service)
+		}
+	}
+	return fn(conn, applied)
+}
+
+// apply runs the up migration and records it in one transaction.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	log.Printf("Applying migration %d_%s of %s", migration.Version, migration.Name, m.service)
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO schema_migrations (service, version, name, applied_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)",
+			m.service, migration.Version, migration.Name)
+		return err
+	})
+}
+
+// revertAll reverts migrations in the given order after making sure that
+// every one of them can be reverted.
+func (m *Migrator) revertAll(ctx context.Context, conn *sql.Conn, migrations []Migration) error {
+	if err := checkReversible(migrations); err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if err := m.revert(ctx, conn, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReversible returns an error naming the first of migrations that has
+// no down file.
+func checkReversible(migrations []Migration) error {
+	for _, migration := range migrations {
+		if migration.Down == "" {
+			return fmt.Errorf("migration %d_%s cannot be reverted, it has no down file", migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+// revert runs the down migration and removes its record in one transaction.
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	log.Printf("Reverting migration %d_%s of %s", migration.Version, migration.Name, m.service)
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		_, err := tx.ExecContext(ctx,
+			"DELETE FROM schema_migrations WHERE service = $1 AND version = $2",
+			m.service, migration.Version)
+		return err
+	})
+}
+
+// inTx runs fn in a transaction on conn, committing if it succeeds.
+func inTx(ctx context.Context, conn *sql.Conn, fn func(*sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
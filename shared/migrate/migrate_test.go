@@ -0,0 +1,141 @@
+package migrate
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		want     []Migration
+		wantErr  string
+		wantLast int64
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"m/0002_second.up.sql":   {Data: []byte("up 2")},
+				"m/0002_second.down.sql": {Data: []byte("down 2")},
+				"m/0010_tenth.up.sql":    {Data: []byte("up 10")},
+				"m/0001_first.up.sql":    {Data: []byte("up 1")},
+			},
+			want: []Migration{
+				{Version: 1, Name: "first", Up: "up 1"},
+				{Version: 2, Name: "second", Up: "up 2", Down: "down 2"},
+				{Version: 10, Name: "tenth", Up: "up 10"},
+			},
+			wantLast: 10,
+		},
+		{
+			name: "other files ignored",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql": {Data: []byte("up 1")},
+				"m/README.md":         {Data: []byte("notes")},
+				"m/schema.sql":        {Data: []byte("old")},
+				"m/sub/0002_x.up.sql": {Data: []byte("nested")},
+			},
+			want:     []Migration{{Version: 1, Name: "first", Up: "up 1"}},
+			wantLast: 1,
+		},
+		{
+			name:  "empty directory",
+			files: fstest.MapFS{"m": {Mode: fs.ModeDir | 0755}},
+		},
+		{
+			name: "shared version",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql": {Data: []byte("up 1")},
+				"m/0001_other.up.sql": {Data: []byte("up 1")},
+			},
+			wantErr: "share version 1",
+		},
+		{
+			name:    "down without up",
+			files:   fstest.MapFS{"m/0001_first.down.sql": {Data: []byte("down 1")}},
+			wantErr: "has no up file",
+		},
+		{
+			name:    "version zero",
+			files:   fstest.MapFS{"m/0000_zero.up.sql": {Data: []byte("up 0")}},
+			wantErr: "invalid migration version",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(nil, "test", tt.files, "m")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.migrations) != len(tt.want) {
+				t.Fatalf("migrations = %+v, want %+v", m.migrations, tt.want)
+			}
+			for i := range tt.want {
+				if m.migrations[i] != tt.want[i] {
+					t.Fatalf("migration %d = %+v, want %+v", i, m.migrations[i], tt.want[i])
+				}
+			}
+			if got := m.Latest(); got != tt.wantLast {
+				t.Fatalf("Latest() = %d, want %d", got, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestCheckReversible(t *testing.T) {
+	tests := []struct {
+		name       string
+		migrations []Migration
+		wantErr    string
+	}{
+		{"none", nil, ""},
+		{"all with down files", []Migration{{Version: 3, Name: "c", Down: "d"}, {Version: 2, Name: "b", Down: "d"}}, ""},
+		{"adopted table", []Migration{{Version: 2, Name: "b", Down: "d"}, {Version: 1, Name: "a"}}, "1_a cannot be reverted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReversible(tt.migrations)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestRunRejectsArguments only covers arguments rejected before the
+// database is touched.
+func TestRunRejectsArguments(t *testing.T) {
+	m := &Migrator{service: "test", migrations: []Migration{{Version: 1, Name: "first", Up: "up 1"}}}
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"sideways"}, "invalid arguments"},
+		{[]string{"up", "1"}, "invalid arguments"},
+		{[]string{"down", "0"}, "invalid number of migrations"},
+		{[]string{"down", "x"}, "invalid number of migrations"},
+		{[]string{"down", "1", "2"}, "invalid arguments"},
+		{[]string{"to"}, "invalid arguments"},
+		{[]string{"to", "-1"}, "invalid version"},
+		{[]string{"to", "7"}, "unknown migration version 7"},
+		{[]string{"status", "all"}, "invalid arguments"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			err := Run(context.Background(), m, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}